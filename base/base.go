@@ -2,227 +2,363 @@ package base
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	data "github.com/KoyamaSohei/ugit/data"
 )
 
+const dateFormat = "Mon Jan 2 15:04:05 2006 -0700"
+
 // Init initialize ugit
-func Init() {
-	data.Init()
+func (repo *Repository) Init() {
+	repo.Repository.Init()
 }
 
 // WriteTree write tree
-func WriteTree(root string) ([]byte, error) {
+func (repo *Repository) WriteTree(root string) ([]byte, error) {
+	ig, err := repo.LoadIgnore()
+	if err != nil {
+		return nil, err
+	}
+	cache := repo.LoadStatCache()
+	h, err := repo.writeTree(root, cache, ig)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		if h, err = repo.HashTreeEntries(nil); err != nil {
+			return nil, err
+		}
+	}
+	if cleanPath(root) == "." {
+		cache.Prune()
+	}
+	if err := cache.Save(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (repo *Repository) writeTree(root string, cache *data.StatCache, ig *Ignore) ([]byte, error) {
 	ents := make([]data.Entry, 0)
-	files, err := ioutil.ReadDir(root)
+	files, err := ioutil.ReadDir(repo.workPath(root))
 	if err != nil {
 		return nil, err
 	}
 
 	for _, f := range files {
 		p := filepath.Join(root, f.Name())
-		if isIgnored(p) {
+		if ig.IsIgnored(p, f.IsDir()) {
 			continue
 		}
 		if !f.IsDir() {
-			dat, err := ioutil.ReadFile(p)
-			if err != nil {
-				return nil, err
+			h, ok := cache.Lookup(cleanPath(p), f)
+			if !ok || !repo.HasObject(h) {
+				dat, err := repo.readWorkFile(p, f)
+				if err != nil {
+					return nil, err
+				}
+				if h, err = repo.HashObject(dat, data.Blob); err != nil {
+					return nil, err
+				}
+				cache.Store(cleanPath(p), h, f)
 			}
-			h, err := data.HashObject(dat, data.Blob)
-			if err != nil {
-				return nil, err
-			}
-			ents = append(ents, data.Entry{Name: p, Oid: h})
+			ents = append(ents, data.Entry{Name: f.Name(), Oid: h, Mode: data.FileMode(f)})
 		} else {
-			h, err := WriteTree(p)
+			h, err := repo.writeTree(p, cache, ig)
 			if err != nil {
 				return nil, err
 			}
-			ents = append(ents, data.Entry{Name: p, Oid: h})
+			if h == nil {
+				continue
+			}
+			ents = append(ents, data.Entry{Name: f.Name(), Oid: h, Mode: data.ModeTree})
 		}
 	}
 
-	return data.HashTreeEntries(ents)
+	// like git, directories without files are not recorded
+	if len(ents) == 0 && cleanPath(root) != "." {
+		return nil, nil
+	}
+	return repo.HashTreeEntries(ents)
+}
+
+// ClearDirectory clear dir, keeping ignored files
+func (repo *Repository) ClearDirectory(root string) error {
+	ig, err := repo.LoadIgnore()
+	if err != nil {
+		return err
+	}
+	return repo.clearDirectory(root, ig)
 }
 
-// ClearDirectory clear dir
-func ClearDirectory(root string) error {
-	files, err := ioutil.ReadDir(root)
+func (repo *Repository) clearDirectory(root string, ig *Ignore) error {
+	files, err := ioutil.ReadDir(repo.workPath(root))
 	if err != nil {
 		return err
 	}
 
 	for _, f := range files {
 		p := filepath.Join(root, f.Name())
-		if isIgnored(p) {
+		if ig.IsIgnored(p, f.IsDir()) {
 			continue
 		}
 		if !f.IsDir() {
 			fmt.Printf("remove %s\n", p)
-			if err := os.Remove(p); err != nil {
+			if err := os.Remove(repo.workPath(p)); err != nil {
 				return err
 			}
 		} else {
-			if err := ClearDirectory(p); err != nil {
+			if err := repo.clearDirectory(p, ig); err != nil {
 				return err
 			}
 		}
 	}
-	if err := os.Remove(root); err != nil {
+	if cleanPath(root) == "." {
+		// worktree root itself is kept
+		return nil
+	}
+	if err := os.Remove(repo.workPath(root)); err != nil {
 		fmt.Printf("warn: not empty dir %s\n", root)
 	}
 	return nil
 }
 
 // ReadTree read tree
-func ReadTree(oid []byte) error {
-	if t, err := data.GetType(oid); err != nil || t != data.Tree {
+func (repo *Repository) ReadTree(oid []byte) error {
+	return repo.readTree(oid, "")
+}
+
+func (repo *Repository) readTree(oid []byte, dir string) error {
+	if t, err := repo.GetType(oid); err != nil || t != data.Tree {
 		return fmt.Errorf("this object is not tree")
 	}
-	ents, err := data.GetTreeEntries(oid)
+	ents, err := repo.GetTreeEntries(oid)
 	if err != nil {
 		return err
 	}
 	for _, e := range ents {
-		t, err := data.GetType(e.Oid)
-		if err != nil {
-			return err
-		}
-		switch t {
-		case data.Tree:
-			if err := os.MkdirAll(e.Name, 0755); err != nil {
-				return err
-			}
-			ReadTree(e.Oid)
-		case data.Blob:
-			b, err := data.GetObject(e.Oid, data.Blob)
-			if err != nil {
+		p := joinPath(dir, e.Name)
+		if e.Mode == data.ModeTree {
+			if err := os.MkdirAll(repo.workPath(p), 0755); err != nil {
 				return err
 			}
-			if err := os.MkdirAll(filepath.Dir(e.Name), 0755); err != nil {
+			if err := repo.readTree(e.Oid, p); err != nil {
 				return err
 			}
-			if err := ioutil.WriteFile(e.Name, b, 0644); err != nil {
-				return err
-			}
-			fmt.Printf("%s: %x\n", e.Name, e.Oid)
+			continue
 		}
+		if err := repo.writeWorkFile(p, e.Oid, e.Mode); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %x\n", p, e.Oid)
 	}
 	return nil
 }
 
-func isIgnored(path string) bool {
-	return strings.Contains(path, ".git") || strings.Contains(path, ".ugit") || strings.Contains(path, "ugit")
+// GetTreeFiles get blob entries in tree recursively, keyed by path.
+// Entry names are full paths.
+func (repo *Repository) GetTreeFiles(oid []byte) (map[string]data.Entry, error) {
+	files := map[string]data.Entry{}
+	if err := repo.getTreeFiles(oid, "", files); err != nil {
+		return nil, err
+	}
+	return files, nil
 }
 
-// Commit commit
-func Commit(mes string) error {
-	dat, err := WriteTree(".")
-	if err != nil {
-		return err
-	}
-	dat = append(dat, []byte{0, 0}...)
-	parent, _ := data.GetRef("HEAD", true)
-	dat = append(dat, parent.Value...)
-	dat = append(dat, []byte{0, 0}...)
-	dat = append(dat, []byte(mes)...)
-	h, err := data.HashObject(dat, data.Commit)
+func (repo *Repository) getTreeFiles(oid []byte, dir string, files map[string]data.Entry) error {
+	ents, err := repo.GetTreeEntries(oid)
 	if err != nil {
 		return err
 	}
-	if err := data.UpdateRef("HEAD", data.RefValue{Symblic: false, Value: h}, true); err != nil {
-		return err
+	for _, e := range ents {
+		e.Name = joinPath(dir, e.Name)
+		if e.Mode == data.ModeTree {
+			if err := repo.getTreeFiles(e.Oid, e.Name, files); err != nil {
+				return err
+			}
+			continue
+		}
+		files[e.Name] = e
 	}
 	return nil
 }
 
-// GetCommit get commit
-func GetCommit(oid []byte) ([]byte, []byte, string, error) {
-	b, err := data.GetObject(oid, data.Commit)
-	if err != nil {
-		return nil, nil, "", err
+// joinPath get path of tree entry name in dir, "" being root
+func joinPath(dir, name string) string {
+	if len(dir) == 0 {
+		return name
 	}
-	prop := bytes.Split(b, []byte{0, 0})
-	if len(prop) != 3 {
-		return nil, nil, "", fmt.Errorf("invalid commit")
+	return dir + "/" + name
+}
+
+// CommitObject is parsed commit
+type CommitObject struct {
+	Tree      []byte
+	Parents   [][]byte
+	Author    data.Signature
+	Committer data.Signature
+	Message   string
+}
+
+// Parent get first parent, or nil for root commit
+func (c CommitObject) Parent() []byte {
+	if len(c.Parents) == 0 {
+		return nil
 	}
-	return prop[0], prop[1], string(prop[2]), nil
+	return c.Parents[0]
 }
 
-// Checkout checkout
-func Checkout(name string) error {
-	oid, err := GetOid(name)
+// Subject get first line of message
+func (c CommitObject) Subject() string {
+	return strings.SplitN(c.Message, "\n", 2)[0]
+}
+
+// Commit commit
+func (repo *Repository) Commit(mes string, author data.Signature) ([]byte, error) {
+	ents, err := repo.ReadIndex()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	t, _, _, err := GetCommit(oid)
+	for _, e := range ents {
+		if e.Conflicted {
+			return nil, fmt.Errorf("%s has unresolved conflicts; add it after resolving", e.Path)
+		}
+	}
+	t, err := repo.WriteIndexTree()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := ClearDirectory("."); err != nil {
-		panic(err)
+	committer, err := repo.GetIdent(data.Committer)
+	if err != nil {
+		return nil, err
 	}
-	if err := ReadTree(t); err != nil {
-		return err
+	c := CommitObject{Tree: t, Author: author, Committer: committer, Message: mes}
+	if parent, err := repo.GetRef("HEAD", true); err == nil {
+		c.Parents = append(c.Parents, parent.Value)
+	}
+	merge, err := repo.GetRef("MERGE_HEAD", false)
+	if err == nil {
+		c.Parents = append(c.Parents, merge.Value)
+	}
+	h, err := repo.writeCommit(c)
+	if err != nil {
+		return nil, err
+	}
+	kind := "commit"
+	switch {
+	case len(c.Parents) == 0:
+		kind = "commit (initial)"
+	case len(c.Parents) > 1:
+		kind = "commit (merge)"
+	}
+	subject := strings.SplitN(mes, "\n", 2)[0]
+	if err := repo.UpdateRef("HEAD", data.RefValue{Symblic: false, Value: h}, true, kind+": "+subject); err != nil {
+		return nil, err
 	}
-	head := data.RefValue{Symblic: false, Value: oid}
-	if isBranch(name) {
-		head = data.RefValue{Symblic: true, Value: []byte(fmt.Sprintf("refs/heads/%s", name))}
+	if len(merge.Value) > 0 {
+		if err := repo.DeleteRef("MERGE_HEAD", false); err != nil {
+			return nil, err
+		}
+		os.Remove(repo.Path("MERGE_MSG"))
 	}
-	return data.UpdateRef("HEAD", head, false)
+	return h, nil
 }
 
-// CreateTag create tag
-func CreateTag(name string, oid []byte) error {
-	path := fmt.Sprintf("refs/tags/%s", name)
-	if err := data.UpdateRef(path, data.RefValue{Symblic: false, Value: oid}, true); err != nil {
-		return err
+func (repo *Repository) writeCommit(c CommitObject) ([]byte, error) {
+	dat := fmt.Sprintf("tree %x\n", c.Tree)
+	for _, p := range c.Parents {
+		dat += fmt.Sprintf("parent %x\n", p)
 	}
-	return nil
+	dat += fmt.Sprintf("author %s\n", c.Author)
+	dat += fmt.Sprintf("committer %s\n", c.Committer)
+	dat += fmt.Sprintf("\n%s", c.Message)
+	return repo.HashObject([]byte(dat), data.Commit)
 }
 
-// GetOid get oid
-func GetOid(oids string) ([]byte, error) {
-	if oids == "@" {
-		b, err := data.GetRef("HEAD", true)
-		if err != nil {
-			return nil, fmt.Errorf("ugit is empty")
-		}
-		return b.Value, nil
+// GetCommit get commit
+func (repo *Repository) GetCommit(oid []byte) (CommitObject, error) {
+	b, err := repo.GetObject(oid, data.Commit)
+	if err != nil {
+		return CommitObject{}, err
 	}
-	prefixs := []string{
-		"",
-		"refs/",
-		"refs/tags/",
-		"refs/heads/",
+	if !bytes.HasPrefix(b, []byte("tree ")) {
+		return getLegacyCommit(oid, b)
 	}
-	for _, p := range prefixs {
-		path := fmt.Sprintf("%s%s", p, oids)
-		b, err := data.GetRef(path, true)
-		if err != nil {
-			continue
+	c := CommitObject{}
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return CommitObject{}, fmt.Errorf("invalid commit %x: missing message", oid)
+		}
+		line := string(b[:i])
+		b = b[i+1:]
+		if len(line) == 0 {
+			break
+		}
+		kv := strings.SplitN(line, " ", 2)
+		if len(kv) != 2 {
+			return CommitObject{}, fmt.Errorf("invalid commit %x: bad header %q", oid, line)
+		}
+		switch kv[0] {
+		case "tree":
+			if c.Tree, err = hex.DecodeString(kv[1]); err != nil {
+				return CommitObject{}, fmt.Errorf("invalid commit %x: %v", oid, err)
+			}
+		case "parent":
+			p, err := hex.DecodeString(kv[1])
+			if err != nil {
+				return CommitObject{}, fmt.Errorf("invalid commit %x: %v", oid, err)
+			}
+			c.Parents = append(c.Parents, p)
+		case "author":
+			if c.Author, err = data.ParseSignature(kv[1]); err != nil {
+				return CommitObject{}, fmt.Errorf("invalid commit %x: %v", oid, err)
+			}
+		case "committer":
+			if c.Committer, err = data.ParseSignature(kv[1]); err != nil {
+				return CommitObject{}, fmt.Errorf("invalid commit %x: %v", oid, err)
+			}
 		}
-		return b.Value, nil
 	}
-	if len(oids) != 40 {
-		return nil, fmt.Errorf("Unknown name %s", oids)
+	if len(c.Tree) == 0 {
+		return CommitObject{}, fmt.Errorf("invalid commit %x: missing tree", oid)
 	}
-	b, err := hex.DecodeString(oids)
-	if err != nil {
-		return nil, err
+	c.Message = string(b)
+	return c, nil
+}
+
+// getLegacyCommit parse `tree 00 00 parent 00 00 message` commit
+func getLegacyCommit(oid, b []byte) (CommitObject, error) {
+	sep := []byte{0, 0}
+	n := sha1.Size
+	if len(b) < n+2 || !bytes.Equal(b[n:n+2], sep) {
+		return CommitObject{}, fmt.Errorf("invalid commit %x", oid)
+	}
+	unknown := data.Signature{When: time.Unix(0, 0).UTC()}
+	c := CommitObject{Tree: b[:n], Author: unknown, Committer: unknown}
+	b = b[n+2:]
+	if len(b) >= n+2 && bytes.Equal(b[n:n+2], sep) {
+		c.Parents = append(c.Parents, b[:n])
+		b = b[n+2:]
+	} else if bytes.HasPrefix(b, sep) {
+		b = b[2:]
+	} else {
+		return CommitObject{}, fmt.Errorf("invalid commit %x", oid)
 	}
-	return b, nil
+	c.Message = string(b)
+	return c, nil
 }
 
 // GetCommitsAndParents get commits and parents
-func GetCommitsAndParents(oidset [][]byte) ([][]byte, error) {
+func (repo *Repository) GetCommitsAndParents(oidset [][]byte) ([][]byte, error) {
 	used := map[string]int{}
 	resset := make([][]byte, 0)
 
@@ -235,27 +371,25 @@ func GetCommitsAndParents(oidset [][]byte) ([][]byte, error) {
 		}
 		used[oids] = 0
 		resset = append(resset, oid)
-		_, p, _, err := GetCommit(oid)
+		c, err := repo.GetCommit(oid)
 		if err != nil {
 			return nil, err
 		}
-		if len(p) > 0 {
-			oidset = append(oidset, p)
-		}
+		oidset = append(oidset, c.Parents...)
 	}
 
 	return resset, nil
 }
 
 // CreateBranch create branch
-func CreateBranch(name string, oid []byte) error {
+func (repo *Repository) CreateBranch(name string, oid []byte) error {
 	path := fmt.Sprintf("refs/heads/%s", name)
-	return data.UpdateRef(path, data.RefValue{Symblic: false, Value: oid}, true)
+	return repo.UpdateRef(path, data.RefValue{Symblic: false, Value: oid}, true, "branch: Created from "+hex.EncodeToString(oid))
 }
 
-func isBranch(branch string) bool {
+func (repo *Repository) isBranch(branch string) bool {
 	path := fmt.Sprintf("refs/heads/%s", branch)
-	_, err := data.GetRef(path, true)
+	_, err := repo.GetRef(path, true)
 	if err != nil {
 		return false
 	}
@@ -263,8 +397,8 @@ func isBranch(branch string) bool {
 }
 
 // GetBranchName get branch
-func GetBranchName() (string, error) {
-	head, err := data.GetRef("HEAD", false)
+func (repo *Repository) GetBranchName() (string, error) {
+	head, err := repo.GetRef("HEAD", false)
 	if err != nil {
 		return "", err
 	}
@@ -275,14 +409,14 @@ func GetBranchName() (string, error) {
 }
 
 // GetBranchNames get branch list
-func GetBranchNames() ([]string, error) {
-	name, _, err := data.GetRefs("refs/heads", false)
+func (repo *Repository) GetBranchNames() ([]string, error) {
+	name, _, err := repo.GetRefs("refs/heads", false)
 	return name, err
 }
 
 // PrintCommit print commit
-func PrintCommit(oid []byte, refs []string) error {
-	t, _, m, err := GetCommit(oid)
+func (repo *Repository) PrintCommit(oid []byte, refs []string) error {
+	c, err := repo.GetCommit(oid)
 	if err != nil {
 		return err
 	}
@@ -293,6 +427,148 @@ func PrintCommit(oid []byte, refs []string) error {
 	if len(ref) > 0 {
 		ref = ref[2:]
 	}
-	fmt.Printf("Commit  %x (%s)\ntree    %x\nmessage %s\n\n", oid, ref, t, m)
+	fmt.Printf("Commit  %x (%s)\ntree    %x\n", oid, ref, c.Tree)
+	for _, p := range c.Parents {
+		fmt.Printf("parent  %x\n", p)
+	}
+	fmt.Printf("author  %s\ndate    %s\n", c.Author.Ident(), c.Author.When.Format(dateFormat))
+	if c.Committer != c.Author {
+		fmt.Printf("committer %s %s\n", c.Committer.Ident(), c.Committer.When.Format(dateFormat))
+	}
+	mes := strings.ReplaceAll(strings.TrimRight(c.Message, "\n"), "\n", "\n        ")
+	fmt.Printf("message %s\n\n", mes)
 	return nil
 }
+
+// Migrate rewrite legacy trees, and commits and annotated tags pointing at them,
+// reachable from refs
+func (repo *Repository) Migrate() ([]string, error) {
+	names, refs, err := repo.GetRefs("", false)
+	if err != nil {
+		return nil, err
+	}
+	m := &migrator{repo: repo, done: map[string][]byte{}}
+	updated := []string{}
+	for i, ref := range refs {
+		if ref.Symblic {
+			continue
+		}
+		t, err := repo.GetType(ref.Value)
+		if err != nil {
+			return nil, err
+		}
+		var noid []byte
+		switch t {
+		case data.Commit:
+			noid, err = m.commit(ref.Value)
+		case data.Tree:
+			noid, err = m.tree(ref.Value)
+		case data.Tag:
+			noid, err = m.tag(ref.Value)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(noid, ref.Value) {
+			continue
+		}
+		if err := repo.UpdateRef(names[i], data.RefValue{Symblic: false, Value: noid}, false, "migrate: rewrite into current object format"); err != nil {
+			return nil, err
+		}
+		updated = append(updated, fmt.Sprintf("%s: %x -> %x", names[i], ref.Value, noid))
+	}
+	return updated, nil
+}
+
+type migrator struct {
+	repo *Repository
+	done map[string][]byte
+}
+
+func (m *migrator) tree(oid []byte) ([]byte, error) {
+	if n, ok := m.done[fmt.Sprintf("%x", oid)]; ok {
+		return n, nil
+	}
+	ents, err := m.repo.GetTreeEntries(oid)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range ents {
+		t, err := m.repo.GetType(e.Oid)
+		if err != nil {
+			return nil, err
+		}
+		if t != data.Tree {
+			continue
+		}
+		if ents[i].Oid, err = m.tree(e.Oid); err != nil {
+			return nil, err
+		}
+	}
+	n, err := m.repo.HashTreeEntries(ents)
+	if err != nil {
+		return nil, err
+	}
+	m.done[fmt.Sprintf("%x", oid)] = n
+	return n, nil
+}
+
+func (m *migrator) commit(oid []byte) ([]byte, error) {
+	if n, ok := m.done[fmt.Sprintf("%x", oid)]; ok {
+		return n, nil
+	}
+	c, err := m.repo.GetCommit(oid)
+	if err != nil {
+		return nil, err
+	}
+	if c.Tree, err = m.tree(c.Tree); err != nil {
+		return nil, err
+	}
+	for i, p := range c.Parents {
+		if c.Parents[i], err = m.commit(p); err != nil {
+			return nil, err
+		}
+	}
+	n, err := m.repo.writeCommit(c)
+	if err != nil {
+		return nil, err
+	}
+	m.done[fmt.Sprintf("%x", oid)] = n
+	return n, nil
+}
+
+// tag rewrite annotated tag, pointing it at rewritten object
+func (m *migrator) tag(oid []byte) ([]byte, error) {
+	if n, ok := m.done[fmt.Sprintf("%x", oid)]; ok {
+		return n, nil
+	}
+	t, err := m.repo.GetTag(oid)
+	if err != nil {
+		return nil, err
+	}
+	var o []byte
+	switch t.Type {
+	case data.Commit:
+		o, err = m.commit(t.Object)
+	case data.Tree:
+		o, err = m.tree(t.Object)
+	case data.Tag:
+		o, err = m.tag(t.Object)
+	default:
+		o = t.Object
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := oid
+	if !bytes.Equal(o, t.Object) {
+		t.Object = o
+		if n, err = m.repo.writeTag(t); err != nil {
+			return nil, err
+		}
+	}
+	m.done[fmt.Sprintf("%x", oid)] = n
+	return n, nil
+}
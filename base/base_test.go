@@ -0,0 +1,403 @@
+package base
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+const (
+	benchDirs  = 100
+	benchFiles = 200
+)
+
+// setupBenchRepo create a repository of benchDirs*benchFiles files in a temp dir
+func setupBenchRepo(b *testing.B) (*Repository, func()) {
+	b.Helper()
+	dir, err := ioutil.TempDir("", "ugit-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := data.NewRepository(dir).Init(); err != nil {
+		b.Fatal(err)
+	}
+	repo, err := Open(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for d := 0; d < benchDirs; d++ {
+		sub := filepath.Join(dir, fmt.Sprintf("dir%03d", d))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for f := 0; f < benchFiles; f++ {
+			p := filepath.Join(sub, fmt.Sprintf("file%03d.txt", f))
+			content := []byte(fmt.Sprintf("%s\n%08192d\n", p, f))
+			if err := ioutil.WriteFile(p, content, 0644); err != nil {
+				b.Fatal(err)
+			}
+			if err := os.Chtimes(p, old, old); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return repo, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func BenchmarkWriteTreeUncached(b *testing.B) {
+	repo, teardown := setupBenchRepo(b)
+	defer teardown()
+	if _, err := repo.WriteTree("."); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		os.Remove(repo.Path("stat-cache"))
+		b.StartTimer()
+		if _, err := repo.WriteTree("."); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteTreeCached(b *testing.B) {
+	repo, teardown := setupBenchRepo(b)
+	defer teardown()
+	if _, err := repo.WriteTree("."); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := repo.WriteTree("."); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRepositoriesParallel(t *testing.T) {
+	for _, name := range []string{"a", "b"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, err := ioutil.TempDir("", "ugit-repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := data.NewRepository(dir).Init(); err != nil {
+				t.Fatal(err)
+			}
+			repo, err := Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, name+".txt"), []byte(name+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.Add([]string{name + ".txt"}); err != nil {
+				t.Fatal(err)
+			}
+			author := data.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0).UTC()}
+			oid, err := repo.Commit("add "+name, author)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := repo.GetCommit(oid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := repo.GetTreeFiles(c.Tree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || files[name+".txt"].Oid == nil {
+				t.Fatalf("files = %v, want only %s.txt", files, name)
+			}
+			sts, err := repo.Status()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sts) != 0 {
+				t.Fatalf("status = %v, want clean", sts)
+			}
+		})
+	}
+}
+
+func TestTreeBasenames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ugit-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := data.NewRepository(dir).Init(); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"a/x", "b/x"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, sub, "f"), []byte("same\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := repo.WriteTree(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents, err := repo.GetTreeEntries(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 || ents[0].Name != "a" || ents[1].Name != "b" {
+		t.Fatalf("entries = %v, want a and b", ents)
+	}
+	if !bytes.Equal(ents[0].Oid, ents[1].Oid) {
+		t.Fatalf("identical subtrees hash differently: %x, %x", ents[0].Oid, ents[1].Oid)
+	}
+	reversed, err := repo.HashTreeEntries([]data.Entry{ents[1], ents[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reversed, root) {
+		t.Fatalf("tree hash depends on entry order: %x, %x", reversed, root)
+	}
+	files, err := repo.GetTreeFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files["b/x/f"]; !ok || len(files) != 2 {
+		t.Fatalf("files = %v, want a/x/f and b/x/f", files)
+	}
+}
+
+func TestAbbreviatedOid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ugit-abbrev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := data.NewRepository(dir).Init(); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string][]byte{}
+	var a, b []byte
+	for i := 0; a == nil; i++ {
+		oid, err := repo.HashObject([]byte(fmt.Sprintf("blob %d\n", i)), data.Blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := fmt.Sprintf("%x", oid[:2])
+		if o, ok := seen[prefix]; ok {
+			a, b = o, oid
+		}
+		seen[prefix] = oid
+	}
+	_, err = repo.GetOid(fmt.Sprintf("%x", a[:2]))
+	if _, ok := err.(*AmbiguousError); !ok {
+		t.Fatalf("err = %v, want ambiguity error", err)
+	}
+	for _, oid := range [][]byte{a, b} {
+		got, err := repo.GetOid(fmt.Sprintf("%x", oid)[:20])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, oid) {
+			t.Fatalf("GetOid = %x, want %x", got, oid)
+		}
+	}
+}
+
+func TestCompareAndSwapRefConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ugit-cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo := data.NewRepository(dir)
+	if err := repo.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const workers, updates = 4, 10
+	blobs := make([][]byte, workers*updates+1)
+	for i := range blobs {
+		if blobs[i], err = repo.HashObject([]byte(fmt.Sprintf("%d\n", i)), data.Blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := map[string][]byte{}
+	for i := 0; i+1 < len(blobs); i++ {
+		next[string(blobs[i])] = blobs[i+1]
+	}
+	if err := repo.UpdateRef("refs/heads/counter", data.RefValue{Value: blobs[0]}, true, "start"); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for n := 0; n < updates; {
+				cur, err := repo.GetRef("refs/heads/counter", true)
+				if err != nil {
+					errs <- err
+					return
+				}
+				err = repo.CompareAndSwapRef("refs/heads/counter", cur.Value, data.RefValue{Value: next[string(cur.Value)]}, true, "increment")
+				switch err.(type) {
+				case nil:
+					n++
+				case *data.RefMismatchError, *data.LockError:
+				default:
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := repo.GetRef("refs/heads/counter", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.Value, blobs[len(blobs)-1]) {
+		t.Fatalf("counter = %x, want %x; an update was lost", r.Value, blobs[len(blobs)-1])
+	}
+	ents, err := repo.ReadReflog("refs/heads/counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != len(blobs) {
+		t.Fatalf("reflog has %d entries, want %d", len(ents), len(blobs))
+	}
+}
+
+func TestHashObjectFreshen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ugit-freshen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := data.NewRepository(dir).Init(); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("written again\n")
+	oid, err := repo.HashObject(content, data.Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := fmt.Sprintf("%x", oid)
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	if err := os.Chtimes(repo.Path("objects", h[:2], h[2:]), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.HashObject(content, data.Blob); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := repo.Prune(time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 0 {
+		t.Fatalf("pruned %x, want object rewritten just now kept", pruned)
+	}
+	if !repo.HasObject(oid) {
+		t.Fatalf("object %s is gone", h)
+	}
+}
+
+func TestResetIndexKeepsLocalChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ugit-reset-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := data.NewRepository(dir).Init(); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(p, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := repo.WriteTree(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte("two\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ResetIndex(tree); err != nil {
+		t.Fatal(err)
+	}
+	sts, err := repo.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range sts {
+		if st.Path == "a.txt" && st.Unstaged == 'M' {
+			return
+		}
+	}
+	t.Fatalf("status = %v, want a.txt modified in working tree", sts)
+}
+
+func TestWriteIndexLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ugit-index-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := data.NewRepository(dir).Init(); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lp := repo.Path("index.lock")
+	if err := ioutil.WriteFile(lp, []byte("held\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = repo.WriteIndex([]data.IndexEntry{{Path: "a", Mode: 0100644, Oid: make([]byte, 20)}})
+	if _, ok := err.(*data.LockError); !ok {
+		t.Fatalf("err = %v, want lock error", err)
+	}
+	if b, err := ioutil.ReadFile(lp); err != nil || string(b) != "held\n" {
+		t.Fatalf("lock file taken over: %q, %v", b, err)
+	}
+	if err := os.Remove(lp); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.WriteIndex(nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,97 @@
+package base
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// branchRef get ref name of branch
+func branchRef(name string) string {
+	return fmt.Sprintf("refs/heads/%s", name)
+}
+
+// IsAncestor report whether commit a is reachable from commit b
+func (repo *Repository) IsAncestor(a, b []byte) (bool, error) {
+	oids, err := repo.GetCommitsAndParents([][]byte{b})
+	if err != nil {
+		return false, err
+	}
+	for _, o := range oids {
+		if bytes.Equal(o, a) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteBranch delete branch, and return the oid it pointed at.
+// A branch not merged into HEAD is kept unless forced.
+func (repo *Repository) DeleteBranch(name string, force bool) ([]byte, error) {
+	r, err := repo.GetRef(branchRef(name), false)
+	if err != nil || r.Symblic {
+		return nil, fmt.Errorf("branch '%s' not found", name)
+	}
+	if cur, _ := repo.GetBranchName(); cur == branchRef(name) {
+		return nil, fmt.Errorf("cannot delete branch '%s' checked out", name)
+	}
+	if !force {
+		merged := false
+		if head, err := repo.GetOid("@"); err == nil {
+			if merged, err = repo.IsAncestor(r.Value, head); err != nil {
+				return nil, err
+			}
+		}
+		if !merged {
+			return nil, fmt.Errorf("the branch '%s' is not fully merged.\n"+
+				"If you are sure you want to delete it, run 'ugit branch -D %s'", name, name)
+		}
+	}
+	if err := repo.CompareAndDeleteRef(branchRef(name), r.Value, false); err != nil {
+		return nil, err
+	}
+	return r.Value, nil
+}
+
+// RenameBranch rename branch old to new with its reflog, and follow it with HEAD.
+// An existing branch new is replaced only if forced.
+func (repo *Repository) RenameBranch(old, new string, force bool) error {
+	oref, nref := branchRef(old), branchRef(new)
+	r, err := repo.GetRef(oref, false)
+	if err != nil || r.Symblic {
+		return fmt.Errorf("no branch named '%s'", old)
+	}
+	if err := data.CheckRefName(nref); err != nil {
+		return err
+	}
+	if oref == nref {
+		return nil
+	}
+	var expect []byte
+	if !force {
+		if repo.HasRef(nref) {
+			return fmt.Errorf("a branch named '%s' already exists", new)
+		}
+		expect = make([]byte, sha1.Size)
+	} else if err := repo.DeleteReflog(nref); err != nil {
+		return err
+	}
+	if err := repo.RenameReflog(oref, nref); err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("branch: renamed %s to %s", oref, nref)
+	if err := repo.CompareAndSwapRef(nref, expect, r, false, msg); err != nil {
+		repo.RenameReflog(nref, oref)
+		return err
+	}
+	if err := repo.CompareAndDeleteRef(oref, r.Value, false); err != nil {
+		return err
+	}
+	head, err := repo.GetRef("HEAD", false)
+	if err == nil && head.Symblic && string(head.Value) == oref {
+		return repo.UpdateRef("HEAD", data.RefValue{Symblic: true, Value: []byte(nref)}, false, msg)
+	}
+	return nil
+}
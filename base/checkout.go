@@ -0,0 +1,278 @@
+package base
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// CheckoutOptions is options of Checkout
+type CheckoutOptions struct {
+	// Force discard local changes of tracked files, and overwrite untracked files
+	Force bool
+	// Merge carry local changes over by three-way merge with target version
+	Merge bool
+	// RemoveStaged remove files only staged from working tree too, with Force
+	RemoveStaged bool
+}
+
+// CheckoutError is returned when checkout or merge would lose local changes
+type CheckoutError struct {
+	Modified  []string
+	Untracked []string
+	// Merge is set when merge refused, rather than checkout
+	Merge bool
+}
+
+func (e *CheckoutError) Error() string {
+	op, action := "checkout", "switch branches"
+	if e.Merge {
+		op, action = "merge", "merge"
+	}
+	s := ""
+	if len(e.Modified) > 0 {
+		s += fmt.Sprintf("Your local changes to the following files would be overwritten by %s:\n", op)
+		for _, p := range e.Modified {
+			s += fmt.Sprintf("\t%s\n", p)
+		}
+	}
+	if len(e.Untracked) > 0 {
+		s += fmt.Sprintf("The following untracked working tree files would be overwritten by %s:\n", op)
+		for _, p := range e.Untracked {
+			s += fmt.Sprintf("\t%s\n", p)
+		}
+	}
+	return s + fmt.Sprintf("Please commit your changes or stash them before you %s.\nAborting", action)
+}
+
+// Checkout switch HEAD to name. Only files differing between current and target
+// trees are updated; local changes to other files and untracked files are kept.
+// `-` is a shorthand for `@{-1}`, the previously checked out branch or commit.
+func (repo *Repository) Checkout(name string, opt CheckoutOptions) error {
+	if name == "-" {
+		name = "@{-1}"
+	}
+	if prev, ok, err := repo.expandPrevious(name); ok {
+		if err != nil {
+			return err
+		}
+		name = prev
+	}
+	oid, err := repo.GetOid(name)
+	if err != nil {
+		return err
+	}
+	if oid, err = repo.Peel(oid, data.Commit); err != nil {
+		return err
+	}
+	c, err := repo.GetCommit(oid)
+	if err != nil {
+		return err
+	}
+	var htree []byte
+	head, err := repo.GetOid("@")
+	if err == nil {
+		hc, err := repo.GetCommit(head)
+		if err != nil {
+			return err
+		}
+		htree = hc.Tree
+	}
+	from := hex.EncodeToString(head)
+	if b, err := repo.GetBranchName(); err == nil && len(b) > 0 {
+		from = strings.TrimPrefix(b, "refs/heads/")
+	}
+	if err := repo.checkoutTree(htree, c.Tree, name, opt); err != nil {
+		return err
+	}
+	ref := data.RefValue{Symblic: false, Value: oid}
+	if repo.isBranch(name) {
+		ref = data.RefValue{Symblic: true, Value: []byte(fmt.Sprintf("refs/heads/%s", name))}
+	}
+	return repo.UpdateRef("HEAD", ref, false, fmt.Sprintf("checkout: moving from %s to %s", from, name))
+}
+
+// checkoutTree move working tree and index from tree to tree
+func (repo *Repository) checkoutTree(from, to []byte, label string, opt CheckoutOptions) error {
+	hfiles, err := repo.treeFiles(from)
+	if err != nil {
+		return err
+	}
+	tfiles, err := repo.treeFiles(to)
+	if err != nil {
+		return err
+	}
+	idx, err := repo.readIndexMap()
+	if err != nil {
+		return err
+	}
+	paths := map[string]bool{}
+	for _, fs := range []map[string]data.Entry{hfiles, tfiles} {
+		for p := range fs {
+			paths[p] = true
+		}
+	}
+	if opt.Force {
+		for p := range idx {
+			paths[p] = true
+		}
+	}
+
+	changed := []string{}
+	local := map[string]data.Entry{}
+	cerr := &CheckoutError{}
+	for p := range paths {
+		h, t := hfiles[p], tfiles[p]
+		if sameEntry(h, t) && !opt.Force {
+			continue
+		}
+		changed = append(changed, p)
+		if opt.Force {
+			continue
+		}
+		w, dirty, err := repo.localChange(idx, p, h, t)
+		if err != nil {
+			return err
+		}
+		if !dirty {
+			continue
+		}
+		_, tracked := idx[p]
+		switch {
+		case h.Oid == nil && !tracked:
+			cerr.Untracked = append(cerr.Untracked, p)
+		case opt.Merge:
+			local[p] = w
+		default:
+			cerr.Modified = append(cerr.Modified, p)
+		}
+	}
+	if len(cerr.Modified) > 0 || len(cerr.Untracked) > 0 {
+		sort.Strings(cerr.Modified)
+		sort.Strings(cerr.Untracked)
+		return cerr
+	}
+
+	sort.Strings(changed)
+	// removals go first, so a file can replace a directory and vice versa
+	for _, p := range changed {
+		if _, ok := local[p]; ok || tfiles[p].Oid != nil {
+			continue
+		}
+		// files only staged are unstaged, but kept in working tree unless asked
+		if hfiles[p].Oid != nil || opt.RemoveStaged {
+			if err := repo.removeWorkFile(p); err != nil {
+				return err
+			}
+		}
+		delete(idx, p)
+	}
+	for _, p := range changed {
+		t := tfiles[p]
+		if w, ok := local[p]; ok {
+			if err := repo.checkoutMerge(idx, p, hfiles[p], w, t, label); err != nil {
+				return err
+			}
+			continue
+		}
+		if t.Oid == nil {
+			continue
+		}
+		if err := repo.writeWorkFile(p, t.Oid, t.Mode); err != nil {
+			return err
+		}
+		fi, err := os.Lstat(repo.workPath(p))
+		if err != nil {
+			return err
+		}
+		idx[p] = data.NewIndexEntry(p, t.Oid, fi)
+	}
+	return repo.writeIndexMap(idx)
+}
+
+// localChange get working tree version of path moving from h to t, and report
+// whether it has local changes: index and working tree must agree, at either version
+func (repo *Repository) localChange(idx map[string]data.IndexEntry, p string, h, t data.Entry) (data.Entry, bool, error) {
+	e, tracked := idx[p]
+	w, err := repo.workEntry(p, e, tracked)
+	if err != nil {
+		return data.Entry{}, false, err
+	}
+	var staged data.Entry
+	if tracked {
+		staged = data.Entry{Oid: e.Oid, Mode: e.Mode}
+	}
+	clean := !e.Conflicted && sameEntry(staged, w) && (sameEntry(w, h) || sameEntry(w, t))
+	return w, !clean, nil
+}
+
+// checkoutMerge merge local version of path into target version,
+// leaving the result in working tree and target version in index
+func (repo *Repository) checkoutMerge(idx map[string]data.IndexEntry, p string, base, w, t data.Entry, label string) error {
+	switch {
+	case w.Oid == nil && t.Oid == nil:
+		delete(idx, p)
+		return nil
+	case t.Oid == nil:
+		fmt.Printf("CONFLICT (modify/delete): %s deleted in %s and modified locally\n", p, label)
+		delete(idx, p)
+		return nil
+	case w.Oid == nil:
+		fmt.Printf("CONFLICT (modify/delete): %s deleted locally and modified in %s\n", p, label)
+		if err := repo.writeWorkFile(p, t.Oid, t.Mode); err != nil {
+			return err
+		}
+		idx[p] = data.IndexEntry{Path: p, Mode: t.Mode, Oid: t.Oid, Conflicted: true}
+		return nil
+	}
+	fi, err := os.Lstat(repo.workPath(p))
+	if err != nil {
+		return err
+	}
+	dat, err := repo.readWorkFile(p, fi)
+	if err != nil {
+		return err
+	}
+	o, err := repo.HashObject(dat, data.Blob)
+	if err != nil {
+		return err
+	}
+	m, conflict, err := repo.mergeBlobs(base.Oid, o, t.Oid, "local", label)
+	if err != nil {
+		return err
+	}
+	mode, _ := mergeMode(base.Mode, w.Mode, t.Mode)
+	if err := repo.writeWorkFile(p, m, mode); err != nil {
+		return err
+	}
+	idx[p] = data.IndexEntry{Path: p, Mode: t.Mode, Oid: t.Oid, Conflicted: conflict}
+	if conflict {
+		fmt.Printf("CONFLICT (content): Merge conflict in %s\n", p)
+	}
+	return nil
+}
+
+// workEntry get blob oid and mode of working tree file, or zero entry if it does not exist
+func (repo *Repository) workEntry(p string, e data.IndexEntry, tracked bool) (data.Entry, error) {
+	fi, err := os.Lstat(repo.workPath(p))
+	if os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+		return data.Entry{}, nil
+	}
+	if err != nil {
+		return data.Entry{}, err
+	}
+	if tracked {
+		if changed, err := repo.isModified(e); err == nil && !changed {
+			return data.Entry{Oid: e.Oid, Mode: e.Mode}, nil
+		}
+	}
+	dat, err := repo.readWorkFile(p, fi)
+	if err != nil {
+		return data.Entry{}, err
+	}
+	return data.Entry{Oid: data.Hash(dat, data.Blob), Mode: data.FileMode(fi)}, nil
+}
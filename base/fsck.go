@@ -0,0 +1,227 @@
+package base
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sort"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// FsckProblem is a finding of Fsck
+type FsckProblem struct {
+	Kind    string `json:"kind"`
+	Type    string `json:"type,omitempty"`
+	Oid     string `json:"oid,omitempty"`
+	Ref     string `json:"ref,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// String format problem as one line
+func (p FsckProblem) String() string {
+	s := p.Kind
+	if len(p.Type) > 0 {
+		s += " " + p.Type
+	}
+	if len(p.Oid) > 0 {
+		s += " " + p.Oid
+	}
+	if len(p.Ref) > 0 {
+		s += " " + p.Ref
+	}
+	if len(p.Message) > 0 {
+		s += ": " + p.Message
+	}
+	return s
+}
+
+// Fatal report whether problem means repository is corrupt
+func (p FsckProblem) Fatal() bool {
+	return p.Kind != "dangling" && p.Kind != "unborn"
+}
+
+// FsckReport is result of Fsck
+type FsckReport struct {
+	Objects  int           `json:"objects"`
+	Refs     int           `json:"refs"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+// Corrupt report whether any fatal problem was found
+func (r *FsckReport) Corrupt() bool {
+	for _, p := range r.Problems {
+		if p.Fatal() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *FsckReport) add(kind string, t data.Type, oid []byte, format string, a ...interface{}) {
+	p := FsckProblem{Kind: kind, Message: fmt.Sprintf(format, a...)}
+	if t != data.None {
+		p.Type = t.String()
+	}
+	if oid != nil {
+		p.Oid = fmt.Sprintf("%x", oid)
+	}
+	r.Problems = append(r.Problems, p)
+}
+
+func (r *FsckReport) addRef(kind, ref, format string, a ...interface{}) {
+	r.Problems = append(r.Problems, FsckProblem{Kind: kind, Ref: ref, Message: fmt.Sprintf(format, a...)})
+}
+
+// Fsck verify hashes and structure of every object, and targets of every ref
+func (repo *Repository) Fsck() (*FsckReport, error) {
+	r := &FsckReport{Problems: []FsckProblem{}}
+	loose, err := repo.ListLooseObjects()
+	if err != nil {
+		return nil, err
+	}
+	packed, err := repo.ListPackedObjects()
+	if err != nil {
+		return nil, err
+	}
+	oids := [][]byte{}
+	types := map[string]data.Type{}
+	for _, o := range append(loose, packed...) {
+		if _, ok := types[string(o)]; ok {
+			continue
+		}
+		types[string(o)] = data.None
+		oids = append(oids, o)
+	}
+	sort.Slice(oids, func(i, j int) bool {
+		return string(oids[i]) < string(oids[j])
+	})
+	r.Objects = len(oids)
+
+	children := map[string][][]byte{}
+	referenced := map[string]bool{}
+	for _, o := range oids {
+		if err := repo.VerifyObject(o); err != nil {
+			r.add("corrupt", data.None, o, "%v", err)
+			continue
+		}
+		t, err := repo.GetType(o)
+		if err != nil {
+			r.add("corrupt", data.None, o, "%v", err)
+			continue
+		}
+		types[string(o)] = t
+	}
+	expect := func(from []byte, ft data.Type, to []byte, want data.Type) {
+		referenced[string(to)] = true
+		children[string(from)] = append(children[string(from)], to)
+		t, ok := types[string(to)]
+		if !ok {
+			r.add("missing", want, to, "referenced by %s %x", ft, from)
+			return
+		}
+		if want != data.None && t != data.None && t != want {
+			r.add("bad-type", t, to, "%s %x expects %s", ft, from, want)
+		}
+	}
+	for _, o := range oids {
+		switch t := types[string(o)]; t {
+		case data.Tree:
+			ents, err := repo.GetTreeEntries(o)
+			if err != nil {
+				r.add("corrupt", t, o, "%v", err)
+				continue
+			}
+			for _, e := range ents {
+				if len(e.Oid) != sha1.Size || len(e.Name) == 0 {
+					r.add("corrupt", t, o, "bad entry %q", e.Name)
+					continue
+				}
+				expect(o, t, e.Oid, data.None)
+			}
+		case data.Commit:
+			c, err := repo.GetCommit(o)
+			if err != nil {
+				r.add("corrupt", t, o, "%v", err)
+				continue
+			}
+			expect(o, t, c.Tree, data.Tree)
+			for _, p := range c.Parents {
+				expect(o, t, p, data.Commit)
+			}
+		case data.Tag:
+			tag, err := repo.GetTag(o)
+			if err != nil {
+				r.add("corrupt", t, o, "%v", err)
+				continue
+			}
+			expect(o, t, tag.Object, tag.Type)
+		}
+	}
+
+	roots := [][]byte{}
+	names, err := repo.ListRefNames()
+	if err != nil {
+		return nil, err
+	}
+	r.Refs = len(names)
+	for _, name := range names {
+		ref, err := repo.GetRef(name, false)
+		if err != nil {
+			r.addRef("broken-ref", name, "%v", err)
+			continue
+		}
+		if ref.Symblic {
+			target := string(ref.Value)
+			if ref, err = repo.GetRef(name, true); err != nil {
+				if _, terr := repo.GetRef(target, false); name == "HEAD" && terr != nil {
+					r.addRef("unborn", name, "points to unborn branch %s", target)
+					continue
+				}
+				r.addRef("broken-ref", name, "%v", err)
+				continue
+			}
+		}
+		if len(ref.Value) != sha1.Size {
+			r.addRef("broken-ref", name, "invalid value %q", ref.Value)
+			continue
+		}
+		t, ok := types[string(ref.Value)]
+		if !ok {
+			r.addRef("broken-ref", name, "points to missing object %x", ref.Value)
+			continue
+		}
+		if t != data.Commit && t != data.Tag {
+			r.addRef("broken-ref", name, "points to %s %x, not a commit", t, ref.Value)
+			continue
+		}
+		roots = append(roots, ref.Value)
+	}
+	if ents, err := repo.ReadIndex(); err != nil {
+		r.addRef("broken-ref", "index", "%v", err)
+	} else {
+		for _, e := range ents {
+			if _, ok := types[string(e.Oid)]; !ok {
+				r.add("missing", data.Blob, e.Oid, "staged as %s", e.Path)
+				continue
+			}
+			roots = append(roots, e.Oid)
+		}
+	}
+
+	reachable := map[string]bool{}
+	for len(roots) > 0 {
+		o := roots[len(roots)-1]
+		roots = roots[:len(roots)-1]
+		if reachable[string(o)] {
+			continue
+		}
+		reachable[string(o)] = true
+		roots = append(roots, children[string(o)]...)
+	}
+	for _, o := range oids {
+		if t := types[string(o)]; t != data.None && !reachable[string(o)] && !referenced[string(o)] {
+			r.add("dangling", t, o, "")
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,240 @@
+package base
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// GetReachableObjects get every object reachable from oids,
+// following tags, commit parents and trees down to blobs
+func (repo *Repository) GetReachableObjects(oids [][]byte) ([][]byte, error) {
+	used := map[string]bool{}
+	res := make([][]byte, 0)
+	for len(oids) > 0 {
+		oid := oids[len(oids)-1]
+		oids = oids[:len(oids)-1]
+		key := fmt.Sprintf("%x", oid)
+		if used[key] {
+			continue
+		}
+		used[key] = true
+		res = append(res, oid)
+		t, err := repo.GetType(oid)
+		if err != nil {
+			return nil, fmt.Errorf("missing object %x: %v", oid, err)
+		}
+		switch t {
+		case data.Commit:
+			c, err := repo.GetCommit(oid)
+			if err != nil {
+				return nil, err
+			}
+			oids = append(oids, c.Tree)
+			oids = append(oids, c.Parents...)
+		case data.Tag:
+			tag, err := repo.GetTag(oid)
+			if err != nil {
+				return nil, err
+			}
+			oids = append(oids, tag.Object)
+		case data.Tree:
+			ents, err := repo.GetTreeEntries(oid)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range ents {
+				oids = append(oids, e.Oid)
+			}
+		}
+	}
+	return res, nil
+}
+
+// getRoots get objects referenced by refs, HEAD, MERGE_HEAD, ORIG_HEAD, reflogs and the index
+func (repo *Repository) getRoots() ([][]byte, error) {
+	roots := [][]byte{}
+	_, refs, err := repo.GetRefs("refs/", false)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range refs {
+		if !r.Symblic {
+			roots = append(roots, r.Value)
+		}
+	}
+	for _, name := range []string{"HEAD", "MERGE_HEAD", "ORIG_HEAD"} {
+		if r, err := repo.GetRef(name, false); err == nil && !r.Symblic {
+			roots = append(roots, r.Value)
+		}
+	}
+	logs, err := repo.ListReflogs()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range logs {
+		ents, err := repo.ReadReflog(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			for _, oid := range [][]byte{e.Old, e.New} {
+				// entries older than an earlier prune may name objects already gone
+				if !data.IsZeroOid(oid) && repo.HasObject(oid) {
+					roots = append(roots, oid)
+				}
+			}
+		}
+	}
+	ents, err := repo.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range ents {
+		roots = append(roots, e.Oid)
+	}
+	return roots, nil
+}
+
+// DefaultPruneExpire is grace period used when gc.pruneExpire is not set
+const DefaultPruneExpire = "2.weeks.ago"
+
+var expireUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// ParseExpire parse grace period such as `now`, `never`, `2.weeks.ago` or `36h`.
+// A negative duration means never expire.
+func ParseExpire(s string) (time.Duration, error) {
+	switch s {
+	case "now", "all":
+		return 0, nil
+	case "never", "false":
+		return -1, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	f := strings.Split(strings.TrimSuffix(s, ".ago"), ".")
+	if len(f) == 2 {
+		n, err := strconv.Atoi(f[0])
+		u, ok := expireUnits[strings.TrimSuffix(f[1], "s")]
+		if err == nil && ok {
+			return time.Duration(n) * u, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid expire %q", s)
+}
+
+// GetPruneExpire get grace period from gc.pruneExpire config
+func (repo *Repository) GetPruneExpire() (time.Duration, error) {
+	s, err := repo.GetConfig("gc.pruneExpire")
+	if err != nil {
+		s = DefaultPruneExpire
+	}
+	return ParseExpire(s)
+}
+
+// Prune delete unreachable loose objects older than expire, and return them.
+// With dryRun, objects are only listed.
+func (repo *Repository) Prune(expire time.Duration, dryRun bool) ([][]byte, error) {
+	roots, err := repo.getRoots()
+	if err != nil {
+		return nil, err
+	}
+	objs, err := repo.GetReachableObjects(roots)
+	if err != nil {
+		return nil, err
+	}
+	reachable := map[string]bool{}
+	for _, o := range objs {
+		reachable[string(o)] = true
+	}
+	loose, err := repo.ListLooseObjects()
+	if err != nil {
+		return nil, err
+	}
+	pruned := [][]byte{}
+	if expire < 0 {
+		return pruned, nil
+	}
+	for _, o := range loose {
+		if reachable[string(o)] {
+			continue
+		}
+		t, err := repo.LooseObjectTime(o)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(t) < expire {
+			continue
+		}
+		pruned = append(pruned, o)
+		if dryRun {
+			continue
+		}
+		if err := repo.RemoveLooseObject(o); err != nil {
+			return nil, err
+		}
+	}
+	return pruned, nil
+}
+
+// GC pack refs and reachable loose objects, deleting their loose copies,
+// then prune unreachable loose objects older than gc.pruneExpire
+func (repo *Repository) GC() error {
+	if _, err := repo.PackRefs(); err != nil {
+		return err
+	}
+	roots, err := repo.getRoots()
+	if err != nil {
+		return err
+	}
+	objs, err := repo.GetReachableObjects(roots)
+	if err != nil {
+		return err
+	}
+	loose := [][]byte{}
+	for _, o := range objs {
+		if repo.IsLoose(o) {
+			loose = append(loose, o)
+		}
+	}
+	if len(loose) == 0 {
+		fmt.Printf("Nothing new to pack.\n")
+		return repo.prune()
+	}
+	name, err := repo.WritePack(loose)
+	if err != nil {
+		return err
+	}
+	for _, o := range loose {
+		if err := repo.RemoveLooseObject(o); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Packed %d objects into %s\n", len(loose), name)
+	return repo.prune()
+}
+
+func (repo *Repository) prune() error {
+	expire, err := repo.GetPruneExpire()
+	if err != nil {
+		return err
+	}
+	pruned, err := repo.Prune(expire, false)
+	if err != nil {
+		return err
+	}
+	if len(pruned) > 0 {
+		fmt.Printf("Pruned %d unreachable objects\n", len(pruned))
+	}
+	return nil
+}
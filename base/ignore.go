@@ -0,0 +1,280 @@
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is name of per-directory ignore files
+const IgnoreFile = ".ugitignore"
+
+// IgnoreRule is a pattern line of an ignore file
+type IgnoreRule struct {
+	Source  string
+	Line    int
+	Pattern string
+	negate  bool
+	dirOnly bool
+	// basename rules have no slash, and match the last path component at any depth
+	basename bool
+	dir      string
+	re       *regexp.Regexp
+}
+
+// Negate report whether rule re-includes paths
+func (r *IgnoreRule) Negate() bool {
+	return r.negate
+}
+
+// builtinIgnores are never tracked, and can not be re-included
+var builtinIgnores = []*IgnoreRule{
+	newBuiltinIgnore(".ugit"),
+	newBuiltinIgnore(".git"),
+}
+
+func newBuiltinIgnore(name string) *IgnoreRule {
+	r, _ := parseIgnoreLine(name, "", "<builtin>", 0)
+	return r
+}
+
+// Ignore match paths against ignore files of a repository.
+// Per-directory files are read lazily, and rules of deeper directories take precedence.
+type Ignore struct {
+	repo    *Repository
+	exclude []*IgnoreRule
+	files   map[string][]*IgnoreRule
+	dirs    map[string]*IgnoreRule
+}
+
+// LoadIgnore load repository exclude file; .ugitignore files are read as paths are matched
+func (repo *Repository) LoadIgnore() (*Ignore, error) {
+	ig := &Ignore{repo: repo, files: map[string][]*IgnoreRule{}, dirs: map[string]*IgnoreRule{}}
+	p := repo.Path("info", "exclude")
+	rules, err := readIgnoreFile(p, "", repo.sourceName(p))
+	if err != nil {
+		return nil, err
+	}
+	ig.exclude = rules
+	return ig, nil
+}
+
+// sourceName get path of file for messages, relative to worktree root if possible
+func (repo *Repository) sourceName(p string) string {
+	if rel, err := filepath.Rel(repo.WorkTree, p); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return p
+}
+
+// Match get rule deciding whether path is ignored, or nil if no rule matches.
+// A path inside an ignored directory matches the directory's rule.
+func (ig *Ignore) Match(path string, isDir bool) *IgnoreRule {
+	path = cleanPath(path)
+	if path == "." {
+		return nil
+	}
+	if dir := filepath.ToSlash(filepath.Dir(path)); dir != "." {
+		if r := ig.matchDir(dir); r != nil && !r.negate {
+			return r
+		}
+	}
+	return ig.match(path, isDir)
+}
+
+// IsIgnored report whether path is ignored
+func (ig *Ignore) IsIgnored(path string, isDir bool) bool {
+	r := ig.Match(path, isDir)
+	return r != nil && !r.negate
+}
+
+func (ig *Ignore) matchDir(dir string) *IgnoreRule {
+	if r, ok := ig.dirs[dir]; ok {
+		return r
+	}
+	var r *IgnoreRule
+	if parent := filepath.ToSlash(filepath.Dir(dir)); parent != "." {
+		if pr := ig.matchDir(parent); pr != nil && !pr.negate {
+			r = pr
+		}
+	}
+	if r == nil {
+		r = ig.match(dir, true)
+	}
+	ig.dirs[dir] = r
+	return r
+}
+
+// match check path itself, assuming its parents are not ignored
+func (ig *Ignore) match(path string, isDir bool) *IgnoreRule {
+	for _, r := range builtinIgnores {
+		if r.matches(path, isDir) {
+			return r
+		}
+	}
+	for dir := filepath.ToSlash(filepath.Dir(path)); ; dir = filepath.ToSlash(filepath.Dir(dir)) {
+		if dir == "." {
+			dir = ""
+		}
+		if r := lastMatch(ig.rules(dir), path, isDir); r != nil {
+			return r
+		}
+		if len(dir) == 0 {
+			break
+		}
+	}
+	return lastMatch(ig.exclude, path, isDir)
+}
+
+func lastMatch(rules []*IgnoreRule, path string, isDir bool) *IgnoreRule {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].matches(path, isDir) {
+			return rules[i]
+		}
+	}
+	return nil
+}
+
+// rules get rules of ignore file in dir, "" being worktree root
+func (ig *Ignore) rules(dir string) []*IgnoreRule {
+	if rules, ok := ig.files[dir]; ok {
+		return rules
+	}
+	p := ig.repo.workPath(filepath.Join(dir, IgnoreFile))
+	rules, err := readIgnoreFile(p, dir, ig.repo.sourceName(p))
+	if err != nil {
+		// unreadable ignore file is treated as empty, like a missing one
+		rules = nil
+	}
+	ig.files[dir] = rules
+	return rules
+}
+
+func (r *IgnoreRule) matches(path string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if len(r.dir) > 0 {
+		if !strings.HasPrefix(path, r.dir+"/") {
+			return false
+		}
+		path = path[len(r.dir)+1:]
+	}
+	if r.basename {
+		path = path[strings.LastIndexByte(path, '/')+1:]
+	}
+	return r.re.MatchString(path)
+}
+
+func readIgnoreFile(path, dir, source string) ([]*IgnoreRule, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rules := []*IgnoreRule{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		if r, ok := parseIgnoreLine(sc.Text(), dir, source, n); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, sc.Err()
+}
+
+// parseIgnoreLine parse a line in gitignore syntax
+func parseIgnoreLine(line, dir, source string, n int) (*IgnoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if len(line) == 0 || line[0] == '#' {
+		return nil, false
+	}
+	r := &IgnoreRule{Source: source, Line: n, Pattern: line, dir: dir}
+	p := line
+	if p[0] == '!' {
+		r.negate = true
+		p = p[1:]
+	} else if p[0] == '\\' && len(p) > 1 && (p[1] == '!' || p[1] == '#') {
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if len(p) == 0 {
+		return nil, false
+	}
+	r.basename = !strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	re, err := regexp.Compile("^" + globRegexp(p, false) + "$")
+	if err != nil {
+		return nil, false
+	}
+	r.re = re
+	return r, true
+}
+
+// globRegexp translate glob with `*`, `?`, `[...]` and `**` into regexp.
+// With crossSlash, `*` and `?` match '/' too, as in ref patterns.
+func globRegexp(p string, crossSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case crossSlash && c == '*':
+			sb.WriteString(".*")
+		case crossSlash && c == '?':
+			sb.WriteString(".")
+		case strings.HasPrefix(p[i:], "**/") && (i == 0 || p[i-1] == '/'):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**") && i+2 == len(p) && (i == 0 || p[i-1] == '/'):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			j := i + 1
+			if j < len(p) && (p[j] == '!' || p[j] == '^') {
+				j++
+			}
+			if j < len(p) && p[j] == ']' {
+				j++
+			}
+			for j < len(p) && p[j] != ']' {
+				j++
+			}
+			if j >= len(p) {
+				sb.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := p[i+1 : j]
+			if len(class) > 0 && class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i = j
+		case c == '\\' && i+1 < len(p):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(p[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// compileRefGlob compile glob pattern for ref names, where `*` matches '/' too
+func compileRefGlob(p string) (*regexp.Regexp, error) {
+	return regexp.Compile("^" + globRegexp(p, true) + "$")
+}
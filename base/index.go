@@ -0,0 +1,259 @@
+package base
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+func cleanPath(p string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Clean(p)), "./")
+}
+
+func isUnder(path, dir string) bool {
+	return dir == "." || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+func (repo *Repository) readIndexMap() (map[string]data.IndexEntry, error) {
+	ents, err := repo.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	idx := map[string]data.IndexEntry{}
+	for _, e := range ents {
+		idx[e.Path] = e
+	}
+	return idx, nil
+}
+
+func (repo *Repository) writeIndexMap(idx map[string]data.IndexEntry) error {
+	ents := make([]data.IndexEntry, 0, len(idx))
+	for _, e := range idx {
+		ents = append(ents, e)
+	}
+	return repo.WriteIndex(ents)
+}
+
+func (repo *Repository) readWorkFile(path string, fi os.FileInfo) ([]byte, error) {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		l, err := os.Readlink(repo.workPath(path))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(l), nil
+	}
+	return ioutil.ReadFile(repo.workPath(path))
+}
+
+func (repo *Repository) addFile(idx map[string]data.IndexEntry, path string, fi os.FileInfo) error {
+	dat, err := repo.readWorkFile(path, fi)
+	if err != nil {
+		return err
+	}
+	h, err := repo.HashObject(dat, data.Blob)
+	if err != nil {
+		return err
+	}
+	idx[path] = data.NewIndexEntry(path, h, fi)
+	return nil
+}
+
+// Add stage files and directories into index.
+// Ignored files are skipped unless already tracked.
+func (repo *Repository) Add(paths []string) error {
+	idx, err := repo.readIndexMap()
+	if err != nil {
+		return err
+	}
+	ig, err := repo.LoadIgnore()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		p = cleanPath(p)
+		fi, err := os.Lstat(repo.workPath(p))
+		if os.IsNotExist(err) {
+			matched := false
+			for k := range idx {
+				if isUnder(k, p) {
+					delete(idx, k)
+					matched = true
+				}
+			}
+			if !matched {
+				return fmt.Errorf("pathspec '%s' did not match any files", p)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			if _, tracked := idx[p]; !tracked && ig.IsIgnored(p, false) {
+				return fmt.Errorf("path '%s' is ignored", p)
+			}
+			if err := repo.addFile(idx, p, fi); err != nil {
+				return err
+			}
+			continue
+		}
+		for k := range idx {
+			if _, err := os.Lstat(repo.workPath(k)); isUnder(k, p) && os.IsNotExist(err) {
+				delete(idx, k)
+			}
+		}
+		err = filepath.Walk(repo.workPath(p), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path, err = filepath.Rel(repo.WorkTree, path); err != nil {
+				return err
+			}
+			path = cleanPath(path)
+			if path != p && ig.IsIgnored(path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				if _, tracked := idx[path]; !tracked {
+					return nil
+				}
+			}
+			if info.IsDir() {
+				return nil
+			}
+			return repo.addFile(idx, path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return repo.writeIndexMap(idx)
+}
+
+// Remove unstage files, and delete them from working tree unless cached
+func (repo *Repository) Remove(paths []string, cached bool) error {
+	idx, err := repo.readIndexMap()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		p = cleanPath(p)
+		matched := false
+		for k := range idx {
+			if !isUnder(k, p) {
+				continue
+			}
+			matched = true
+			delete(idx, k)
+			if cached {
+				continue
+			}
+			if err := os.Remove(repo.workPath(k)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			fmt.Printf("rm '%s'\n", k)
+		}
+		if !matched {
+			return fmt.Errorf("pathspec '%s' did not match any files", p)
+		}
+	}
+	return repo.writeIndexMap(idx)
+}
+
+// ResetPaths reset index entries of paths to commit's version
+func (repo *Repository) ResetPaths(oid []byte, paths []string) error {
+	files := map[string]data.Entry{}
+	if len(oid) > 0 {
+		c, err := repo.GetCommit(oid)
+		if err != nil {
+			return err
+		}
+		if files, err = repo.GetTreeFiles(c.Tree); err != nil {
+			return err
+		}
+	}
+	idx, err := repo.readIndexMap()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		p = cleanPath(p)
+		for k := range idx {
+			if isUnder(k, p) {
+				delete(idx, k)
+			}
+		}
+		for k, o := range files {
+			if isUnder(k, p) {
+				idx[k] = data.IndexEntry{Path: k, Mode: o.Mode, Oid: o.Oid}
+			}
+		}
+	}
+	return repo.writeIndexMap(idx)
+}
+
+// ResetIndex replace index with tree's files, leaving working tree alone.
+// Stat data is kept only for entries already staging the same blob, so
+// working tree files differing from tree show up as modified.
+func (repo *Repository) ResetIndex(tree []byte) error {
+	files, err := repo.GetTreeFiles(tree)
+	if err != nil {
+		return err
+	}
+	idx, err := repo.readIndexMap()
+	if err != nil {
+		return err
+	}
+	ents := make([]data.IndexEntry, 0, len(files))
+	for p, o := range files {
+		if e, ok := idx[p]; ok && !e.Conflicted && sameEntry(data.Entry{Oid: e.Oid, Mode: e.Mode}, o) {
+			ents = append(ents, e)
+			continue
+		}
+		ents = append(ents, data.IndexEntry{Path: p, Mode: o.Mode, Oid: o.Oid})
+	}
+	return repo.WriteIndex(ents)
+}
+
+// WriteIndexTree write tree from index
+func (repo *Repository) WriteIndexTree() ([]byte, error) {
+	ents, err := repo.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return repo.writeIndexTree(ents, "")
+}
+
+func (repo *Repository) writeIndexTree(ents []data.IndexEntry, dir string) ([]byte, error) {
+	tents := make([]data.Entry, 0)
+	subs := map[string][]data.IndexEntry{}
+	names := []string{}
+	for _, e := range ents {
+		rest := strings.TrimPrefix(e.Path, dir)
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			tents = append(tents, data.Entry{Name: rest, Oid: e.Oid, Mode: e.Mode})
+			continue
+		}
+		sub := dir + rest[:i+1]
+		if _, ok := subs[sub]; !ok {
+			names = append(names, sub)
+		}
+		subs[sub] = append(subs[sub], e)
+	}
+	sort.Strings(names)
+	for _, sub := range names {
+		h, err := repo.writeIndexTree(subs[sub], sub)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(sub, dir), "/")
+		tents = append(tents, data.Entry{Name: name, Oid: h, Mode: data.ModeTree})
+	}
+	return repo.HashTreeEntries(tents)
+}
@@ -0,0 +1,430 @@
+package base
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	data "github.com/KoyamaSohei/ugit/data"
+	diff "github.com/KoyamaSohei/ugit/diff"
+)
+
+// GetMergeBase get best common ancestor of two commits, or nil if unrelated.
+// A common ancestor is best when it is not an ancestor of another common ancestor.
+func (repo *Repository) GetMergeBase(a, b []byte) ([]byte, error) {
+	aset, err := repo.GetCommitsAndParents([][]byte{a})
+	if err != nil {
+		return nil, err
+	}
+	ancestors := map[string]bool{}
+	for _, o := range aset {
+		ancestors[string(o)] = true
+	}
+	bset, err := repo.GetCommitsAndParents([][]byte{b})
+	if err != nil {
+		return nil, err
+	}
+	common := [][]byte{}
+	parents := [][]byte{}
+	for _, o := range bset {
+		if !ancestors[string(o)] {
+			continue
+		}
+		common = append(common, o)
+		c, err := repo.GetCommit(o)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, c.Parents...)
+	}
+	// every commit reachable from a parent of a common ancestor is not best
+	below, err := repo.GetCommitsAndParents(parents)
+	if err != nil {
+		return nil, err
+	}
+	worse := map[string]bool{}
+	for _, o := range below {
+		worse[string(o)] = true
+	}
+	for _, o := range common {
+		if !worse[string(o)] {
+			return o, nil
+		}
+	}
+	return nil, nil
+}
+
+// MergeTrees merge ours and theirs trees against base tree.
+// It returns merged blob entries keyed by path, and paths left with conflicts.
+func (repo *Repository) MergeTrees(btree, otree, ttree []byte, oursLabel, theirsLabel string) (map[string]data.Entry, []string, error) {
+	bfiles, err := repo.treeFiles(btree)
+	if err != nil {
+		return nil, nil, err
+	}
+	ofiles, err := repo.treeFiles(otree)
+	if err != nil {
+		return nil, nil, err
+	}
+	tfiles, err := repo.treeFiles(ttree)
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := map[string]bool{}
+	for _, fs := range []map[string]data.Entry{bfiles, ofiles, tfiles} {
+		for p := range fs {
+			paths[p] = true
+		}
+	}
+	merged := map[string]data.Entry{}
+	conflicts := []string{}
+	for p := range paths {
+		b, o, t := bfiles[p], ofiles[p], tfiles[p]
+		switch {
+		case sameEntry(o, t), sameEntry(b, t):
+			if o.Oid != nil {
+				merged[p] = o
+			}
+			continue
+		case sameEntry(b, o):
+			if t.Oid != nil {
+				merged[p] = t
+			}
+			continue
+		case o.Oid == nil || t.Oid == nil:
+			fmt.Printf("CONFLICT (modify/delete): %s\n", p)
+			merged[p] = o
+			if o.Oid == nil {
+				merged[p] = t
+			}
+			conflicts = append(conflicts, p)
+			continue
+		}
+		mode, ok := mergeMode(b.Mode, o.Mode, t.Mode)
+		if !ok {
+			fmt.Printf("CONFLICT (mode): %s is %o in %s and %o in %s\n", p, o.Mode, oursLabel, t.Mode, theirsLabel)
+		}
+		h, conflict := o.Oid, !ok
+		switch {
+		case bytes.Equal(o.Oid, t.Oid), bytes.Equal(b.Oid, t.Oid):
+		case bytes.Equal(b.Oid, o.Oid):
+			h = t.Oid
+		default:
+			var c bool
+			if h, c, err = repo.mergeBlobs(b.Oid, o.Oid, t.Oid, oursLabel, theirsLabel); err != nil {
+				return nil, nil, err
+			}
+			if c {
+				fmt.Printf("CONFLICT (content): Merge conflict in %s\n", p)
+				conflict = true
+			}
+		}
+		if conflict {
+			conflicts = append(conflicts, p)
+		}
+		merged[p] = data.Entry{Name: p, Oid: h, Mode: mode}
+	}
+	sort.Strings(conflicts)
+	return merged, conflicts, nil
+}
+
+func (repo *Repository) treeFiles(tree []byte) (map[string]data.Entry, error) {
+	if len(tree) == 0 {
+		return map[string]data.Entry{}, nil
+	}
+	return repo.GetTreeFiles(tree)
+}
+
+// sameEntry report whether entries have same content and mode; missing entries are zero
+func sameEntry(a, b data.Entry) bool {
+	return bytes.Equal(a.Oid, b.Oid) && a.Mode == b.Mode
+}
+
+// mergeMode merge modes of ours and theirs against base, ok is false if both changed it
+func mergeMode(b, o, t uint32) (uint32, bool) {
+	switch {
+	case o == t, b == t:
+		return o, true
+	case b == o:
+		return t, true
+	}
+	return o, false
+}
+
+func (repo *Repository) mergeBlobs(b, o, t []byte, oursLabel, theirsLabel string) ([]byte, bool, error) {
+	bd := []byte{}
+	if b != nil {
+		var err error
+		if bd, err = repo.GetObject(b, data.Blob); err != nil {
+			return nil, false, err
+		}
+	}
+	od, err := repo.GetObject(o, data.Blob)
+	if err != nil {
+		return nil, false, err
+	}
+	td, err := repo.GetObject(t, data.Blob)
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.IndexByte(od, 0) >= 0 || bytes.IndexByte(td, 0) >= 0 {
+		// binary content can not be merged line by line, keep ours
+		return o, true, nil
+	}
+	m, conflict := diff.Merge3(bd, od, td, oursLabel, theirsLabel)
+	h, err := repo.HashObject(m, data.Blob)
+	if err != nil {
+		return nil, false, err
+	}
+	return h, conflict, nil
+}
+
+// writeWorkFile write blob to working tree as file of mode
+func (repo *Repository) writeWorkFile(path string, oid []byte, mode uint32) error {
+	b, err := repo.GetObject(oid, data.Blob)
+	if err != nil {
+		return err
+	}
+	path = repo.workPath(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// symlinks can not be rewritten in place, and writing through one would change its target
+	if fi, err := os.Lstat(path); err == nil && (mode == data.ModeSymlink || fi.Mode()&os.ModeSymlink != 0) {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if mode == data.ModeSymlink {
+		return os.Symlink(string(b), path)
+	}
+	perm := os.FileMode(0644)
+	if mode == data.ModeExecutable {
+		perm = 0755
+	}
+	if err := ioutil.WriteFile(path, b, perm); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
+
+func (repo *Repository) removeWorkFile(path string) error {
+	if err := os.Remove(repo.workPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if err := os.Remove(repo.workPath(dir)); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Merge merge commit into HEAD
+func (repo *Repository) Merge(name string, author data.Signature) error {
+	if _, err := repo.GetRef("MERGE_HEAD", false); err == nil {
+		return fmt.Errorf("merge is in progress; commit or reset first")
+	}
+	oid, err := repo.GetOid(name)
+	if err != nil {
+		return err
+	}
+	if oid, err = repo.Peel(oid, data.Commit); err != nil {
+		return err
+	}
+	head, err := repo.GetOid("@")
+	if err != nil {
+		return err
+	}
+	hc, err := repo.GetCommit(head)
+	if err != nil {
+		return err
+	}
+	it, err := repo.WriteIndexTree()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(it, hc.Tree) {
+		return fmt.Errorf("your index contains uncommitted changes; commit them before merging")
+	}
+	mbase, err := repo.GetMergeBase(head, oid)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(mbase, oid) {
+		fmt.Printf("Already up to date.\n")
+		return nil
+	}
+	oc, err := repo.GetCommit(oid)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(mbase, head) {
+		tfiles, err := repo.treeFiles(oc.Tree)
+		if err != nil {
+			return err
+		}
+		if err := repo.checkMergeWorkTree(hc.Tree, tfiles); err != nil {
+			return err
+		}
+		fmt.Printf("Updating %x..%x\nFast-forward\n", head[:10], oid[:10])
+		if err := repo.applyMerge(hc.Tree, tfiles, nil); err != nil {
+			return err
+		}
+		return repo.UpdateRef("HEAD", data.RefValue{Symblic: false, Value: oid}, true, fmt.Sprintf("merge %s: Fast-forward", name))
+	}
+
+	var btree []byte
+	if len(mbase) > 0 {
+		bc, err := repo.GetCommit(mbase)
+		if err != nil {
+			return err
+		}
+		btree = bc.Tree
+	}
+	merged, conflicts, err := repo.MergeTrees(btree, hc.Tree, oc.Tree, "HEAD", name)
+	if err != nil {
+		return err
+	}
+	if err := repo.checkMergeWorkTree(hc.Tree, merged); err != nil {
+		return err
+	}
+	if err := repo.applyMerge(hc.Tree, merged, conflicts); err != nil {
+		return err
+	}
+	if err := repo.UpdateRef("MERGE_HEAD", data.RefValue{Symblic: false, Value: oid}, false, ""); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(repo.Path("MERGE_MSG"), []byte(fmt.Sprintf("Merge %s", name)), 0644); err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		fmt.Printf("Automatic merge failed; fix conflicts and then commit the result.\n")
+		return nil
+	}
+	_, err = repo.Commit(fmt.Sprintf("Merge %s", name), author)
+	return err
+}
+
+// updateWorkTree apply changes between trees to working tree.
+// If files is given, it is used instead of the target tree's contents.
+func (repo *Repository) updateWorkTree(from, to []byte, files map[string]data.Entry) error {
+	ffiles, err := repo.treeFiles(from)
+	if err != nil {
+		return err
+	}
+	if files == nil {
+		if files, err = repo.treeFiles(to); err != nil {
+			return err
+		}
+	}
+	for p := range ffiles {
+		if _, ok := files[p]; !ok {
+			fmt.Printf("remove %s\n", p)
+			if err := repo.removeWorkFile(p); err != nil {
+				return err
+			}
+		}
+	}
+	for p, o := range files {
+		if sameEntry(ffiles[p], o) {
+			continue
+		}
+		if err := repo.writeWorkFile(p, o.Oid, o.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMergeWorkTree refuse merge result files when writing them over head tree
+// would lose local changes, like checkout does
+func (repo *Repository) checkMergeWorkTree(head []byte, files map[string]data.Entry) error {
+	hfiles, err := repo.treeFiles(head)
+	if err != nil {
+		return err
+	}
+	idx, err := repo.readIndexMap()
+	if err != nil {
+		return err
+	}
+	paths := map[string]bool{}
+	for _, fs := range []map[string]data.Entry{hfiles, files} {
+		for p := range fs {
+			paths[p] = true
+		}
+	}
+	cerr := &CheckoutError{Merge: true}
+	for p := range paths {
+		h, t := hfiles[p], files[p]
+		if sameEntry(h, t) {
+			continue
+		}
+		_, dirty, err := repo.localChange(idx, p, h, t)
+		if err != nil {
+			return err
+		}
+		if !dirty {
+			continue
+		}
+		if _, tracked := idx[p]; h.Oid == nil && !tracked {
+			cerr.Untracked = append(cerr.Untracked, p)
+		} else {
+			cerr.Modified = append(cerr.Modified, p)
+		}
+	}
+	if len(cerr.Modified) > 0 || len(cerr.Untracked) > 0 {
+		sort.Strings(cerr.Modified)
+		sort.Strings(cerr.Untracked)
+		return cerr
+	}
+	return nil
+}
+
+// applyMerge write merged files to working tree and index.
+// Stat data is taken only for files written, so local changes to others
+// still show up as modified.
+func (repo *Repository) applyMerge(head []byte, merged map[string]data.Entry, conflicts []string) error {
+	if err := repo.updateWorkTree(head, nil, merged); err != nil {
+		return err
+	}
+	hfiles, err := repo.treeFiles(head)
+	if err != nil {
+		return err
+	}
+	idx, err := repo.readIndexMap()
+	if err != nil {
+		return err
+	}
+	conflicted := map[string]bool{}
+	for _, p := range conflicts {
+		conflicted[p] = true
+	}
+	ents := make([]data.IndexEntry, 0, len(merged))
+	for p, o := range merged {
+		if conflicted[p] {
+			io := hfiles[p]
+			if io.Oid == nil {
+				io = o
+			}
+			ents = append(ents, data.IndexEntry{Path: p, Mode: io.Mode, Oid: io.Oid, Conflicted: true})
+			continue
+		}
+		if sameEntry(hfiles[p], o) {
+			if e, ok := idx[p]; ok && !e.Conflicted && sameEntry(data.Entry{Oid: e.Oid, Mode: e.Mode}, o) {
+				ents = append(ents, e)
+			} else {
+				ents = append(ents, data.IndexEntry{Path: p, Mode: o.Mode, Oid: o.Oid})
+			}
+			continue
+		}
+		fi, err := os.Lstat(repo.workPath(p))
+		if err != nil {
+			return err
+		}
+		ents = append(ents, data.NewIndexEntry(p, o.Oid, fi))
+	}
+	return repo.WriteIndex(ents)
+}
@@ -0,0 +1,694 @@
+package base
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// RebaseDir holds state of a rebase in progress, so it survives across invocations
+const RebaseDir = "rebase-merge"
+
+// RebaseOptions is options of Rebase
+type RebaseOptions struct {
+	// Interactive let user edit the todo list before replaying
+	Interactive bool
+	// Edit open file in editor, for todo list and commit messages
+	Edit func(path string) error
+}
+
+// RebaseConflictError is returned when a commit can not be replayed cleanly
+type RebaseConflictError struct {
+	Oid     []byte
+	Subject string
+}
+
+func (e *RebaseConflictError) Error() string {
+	return fmt.Sprintf("could not apply %s... %s\n"+
+		"Resolve all conflicts manually, mark them as resolved with \"ugit add <paths>\",\n"+
+		"then run \"ugit rebase --continue\".\n"+
+		"You can instead skip this commit: run \"ugit rebase --skip\".\n"+
+		"To abort and get back to the state before \"ugit rebase\", run \"ugit rebase --abort\".",
+		ShortOid(e.Oid), e.Subject)
+}
+
+// rebaseStep is a line of todo list
+type rebaseStep struct {
+	Cmd     string
+	Oid     []byte
+	Subject string
+}
+
+func (s rebaseStep) String() string {
+	return fmt.Sprintf("%s %x %s", s.Cmd, s.Oid, s.Subject)
+}
+
+var rebaseCmds = map[string]string{
+	"p": "pick", "pick": "pick",
+	"r": "reword", "reword": "reword",
+	"e": "edit", "edit": "edit",
+	"s": "squash", "squash": "squash",
+	"f": "fixup", "fixup": "fixup",
+	"d": "drop", "drop": "drop",
+}
+
+const todoHelp = `
+# Commands:
+# p, pick <commit> = use commit
+# r, reword <commit> = use commit, but edit the commit message
+# e, edit <commit> = use commit, but stop for amending
+# s, squash <commit> = use commit, but meld into previous commit
+# f, fixup <commit> = like "squash", but discard this commit's log message
+# d, drop <commit> = remove commit
+#
+# These lines can be re-ordered; they are executed from top to bottom.
+# If you remove everything, the rebase will be aborted.
+`
+
+func (repo *Repository) rebasePath(name string) string {
+	return repo.Path(RebaseDir, name)
+}
+
+func (repo *Repository) readRebaseFile(name string) (string, error) {
+	b, err := ioutil.ReadFile(repo.rebasePath(name))
+	return strings.TrimSpace(string(b)), err
+}
+
+func (repo *Repository) writeRebaseFile(name, s string) error {
+	return ioutil.WriteFile(repo.rebasePath(name), []byte(s), 0644)
+}
+
+// RebaseInProgress report whether a rebase is stopped, waiting for --continue
+func (repo *Repository) RebaseInProgress() bool {
+	fi, err := os.Stat(repo.Path(RebaseDir))
+	return err == nil && fi.IsDir()
+}
+
+// Rebase replay commits of HEAD not in upstream onto upstream, one by one.
+// It stops on conflicts, and on edit steps, until RebaseContinue.
+func (repo *Repository) Rebase(upstream string, opt RebaseOptions) error {
+	if repo.RebaseInProgress() {
+		return fmt.Errorf("a rebase is already in progress; use --continue, --skip or --abort")
+	}
+	if repo.HasRef("MERGE_HEAD") {
+		return fmt.Errorf("merge is in progress; commit or reset first")
+	}
+	sts, err := repo.Status()
+	if err != nil {
+		return err
+	}
+	for _, st := range sts {
+		if st.Staged != '?' && (st.Staged != ' ' || st.Unstaged != ' ') {
+			return fmt.Errorf("cannot rebase: you have uncommitted changes; commit or reset them first")
+		}
+	}
+	head, err := repo.GetOid("@")
+	if err != nil {
+		return err
+	}
+	onto, err := repo.GetOid(upstream)
+	if err != nil {
+		return err
+	}
+	if onto, err = repo.Peel(onto, data.Commit); err != nil {
+		return err
+	}
+	headName := "detached HEAD"
+	if b, err := repo.GetBranchName(); err == nil && len(b) > 0 {
+		headName = b
+	}
+	if !opt.Interactive {
+		if ok, err := repo.IsAncestor(onto, head); err != nil {
+			return err
+		} else if ok {
+			fmt.Printf("Current branch %s is up to date.\n", strings.TrimPrefix(headName, "refs/heads/"))
+			return nil
+		}
+	}
+	oids, err := repo.rebaseCommits(onto, head)
+	if err != nil {
+		return err
+	}
+	steps := make([]rebaseStep, 0, len(oids))
+	for _, oid := range oids {
+		c, err := repo.GetCommit(oid)
+		if err != nil {
+			return err
+		}
+		steps = append(steps, rebaseStep{Cmd: "pick", Oid: oid, Subject: c.Subject()})
+	}
+
+	hc, err := repo.GetCommit(head)
+	if err != nil {
+		return err
+	}
+	oc, err := repo.GetCommit(onto)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(repo.Path(RebaseDir), 0755); err != nil {
+		return err
+	}
+	// no rebase is in progress until HEAD is at onto
+	fail := func(err error) error {
+		os.RemoveAll(repo.Path(RebaseDir))
+		return err
+	}
+	if opt.Interactive {
+		if steps, err = repo.editTodo(steps, onto, head, opt); err != nil {
+			return fail(err)
+		}
+		if len(steps) == 0 {
+			os.RemoveAll(repo.Path(RebaseDir))
+			fmt.Printf("Nothing to do\n")
+			return nil
+		}
+	}
+	if err := repo.checkoutTree(hc.Tree, oc.Tree, upstream, CheckoutOptions{}); err != nil {
+		return fail(err)
+	}
+	if err := repo.writeTodo("git-rebase-todo", steps); err != nil {
+		return fail(err)
+	}
+	for name, v := range map[string]string{
+		"head-name": headName,
+		"onto":      hex.EncodeToString(onto),
+		"orig-head": hex.EncodeToString(head),
+		"done":      "",
+	} {
+		if err := repo.writeRebaseFile(name, v); err != nil {
+			return fail(err)
+		}
+	}
+	if err := repo.UpdateRef("ORIG_HEAD", data.RefValue{Symblic: false, Value: head}, false, ""); err != nil {
+		return fail(err)
+	}
+	if err := repo.UpdateRef("HEAD", data.RefValue{Symblic: false, Value: onto}, false, "rebase (start): checkout "+upstream); err != nil {
+		return fail(err)
+	}
+	return repo.runRebase(opt)
+}
+
+// rebaseCommits get non-merge commits reachable from head but not from onto,
+// parents before children
+func (repo *Repository) rebaseCommits(onto, head []byte) ([][]byte, error) {
+	oids, err := repo.GetRangeCommits(RevRange{From: onto, To: head})
+	if err != nil {
+		return nil, err
+	}
+	in := map[string]bool{}
+	for _, oid := range oids {
+		in[string(oid)] = true
+	}
+	res := [][]byte{}
+	var visit func(oid []byte) error
+	visit = func(oid []byte) error {
+		if !in[string(oid)] {
+			return nil
+		}
+		delete(in, string(oid))
+		c, err := repo.GetCommit(oid)
+		if err != nil {
+			return err
+		}
+		for _, p := range c.Parents {
+			if err := visit(p); err != nil {
+				return err
+			}
+		}
+		if len(c.Parents) <= 1 {
+			res = append(res, oid)
+		}
+		return nil
+	}
+	return res, visit(head)
+}
+
+// editTodo let user edit steps in editor, and parse the result
+func (repo *Repository) editTodo(steps []rebaseStep, onto, head []byte, opt RebaseOptions) ([]rebaseStep, error) {
+	var buf bytes.Buffer
+	for _, s := range steps {
+		fmt.Fprintf(&buf, "%s %s %s\n", s.Cmd, ShortOid(s.Oid), s.Subject)
+	}
+	fmt.Fprintf(&buf, "\n# Rebase %s..%s onto %s (%d commands)\n#", ShortOid(onto), ShortOid(head), ShortOid(onto), len(steps))
+	buf.WriteString(todoHelp)
+	p := repo.rebasePath("git-rebase-todo")
+	if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	if opt.Edit == nil {
+		return nil, fmt.Errorf("no editor to edit todo list")
+	}
+	if err := opt.Edit(p); err != nil {
+		return nil, err
+	}
+	steps, err := repo.readTodo("git-rebase-todo")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		if s.Cmd != "drop" {
+			if s.Cmd == "squash" || s.Cmd == "fixup" {
+				return nil, fmt.Errorf("cannot '%s' without a previous commit", s.Cmd)
+			}
+			break
+		}
+	}
+	return steps, nil
+}
+
+// readTodo parse todo list file, resolving commits
+func (repo *Repository) readTodo(name string) ([]rebaseStep, error) {
+	b, err := ioutil.ReadFile(repo.rebasePath(name))
+	if err != nil {
+		return nil, err
+	}
+	steps := []rebaseStep{}
+	for n, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		f := strings.SplitN(line, " ", 3)
+		cmd, ok := rebaseCmds[f[0]]
+		if !ok || len(f) < 2 {
+			return nil, fmt.Errorf("invalid line %d: %s", n+1, line)
+		}
+		oid, err := repo.GetOid(f[1])
+		if err == nil {
+			oid, err = repo.Peel(oid, data.Commit)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %d: %s: %v", n+1, line, err)
+		}
+		s := rebaseStep{Cmd: cmd, Oid: oid}
+		if len(f) == 3 {
+			s.Subject = f[2]
+		}
+		steps = append(steps, s)
+	}
+	return steps, nil
+}
+
+func (repo *Repository) writeTodo(name string, steps []rebaseStep) error {
+	var buf bytes.Buffer
+	for _, s := range steps {
+		buf.WriteString(s.String() + "\n")
+	}
+	return repo.writeRebaseFile(name, buf.String())
+}
+
+// runRebase replay remaining steps of todo list, then finish rebase
+func (repo *Repository) runRebase(opt RebaseOptions) error {
+	for {
+		todo, err := repo.readTodo("git-rebase-todo")
+		if err != nil {
+			return err
+		}
+		if len(todo) == 0 {
+			return repo.finishRebase()
+		}
+		s := todo[0]
+		done, err := repo.readTodo("done")
+		if err != nil {
+			return err
+		}
+		if err := repo.writeTodo("done", append(done, s)); err != nil {
+			return err
+		}
+		if err := repo.writeTodo("git-rebase-todo", todo[1:]); err != nil {
+			return err
+		}
+		if s.Cmd == "drop" {
+			continue
+		}
+		// the step is in progress until its commit is made
+		if err := repo.writeRebaseFile("stopped-sha", hex.EncodeToString(s.Oid)); err != nil {
+			return err
+		}
+		if err := repo.applyStep(s); err != nil {
+			return err
+		}
+		h, err := repo.commitStep(s, opt)
+		if err != nil {
+			return err
+		}
+		// an edit step dropped as already upstream leaves nothing to amend
+		if s.Cmd == "edit" && h != nil {
+			return repo.stopForEdit(s, h)
+		}
+	}
+}
+
+// applyStep merge changes of step's commit into index and working tree.
+// A pick of a commit whose parent is HEAD is fast-forwarded instead.
+func (repo *Repository) applyStep(s rebaseStep) error {
+	head, err := repo.GetOid("@")
+	if err != nil {
+		return err
+	}
+	hc, err := repo.GetCommit(head)
+	if err != nil {
+		return err
+	}
+	c, err := repo.GetCommit(s.Oid)
+	if err != nil {
+		return err
+	}
+	label := fmt.Sprintf("%s (%s)", ShortOid(s.Oid), c.Subject())
+	if s.Cmd == "pick" && len(c.Parents) == 1 && bytes.Equal(c.Parents[0], head) {
+		if err := repo.checkoutTree(hc.Tree, c.Tree, label, CheckoutOptions{}); err != nil {
+			return err
+		}
+		if err := repo.UpdateRef("HEAD", data.RefValue{Symblic: false, Value: s.Oid}, false, "rebase (pick): "+c.Subject()); err != nil {
+			return err
+		}
+		return os.Remove(repo.rebasePath("stopped-sha"))
+	}
+	var btree []byte
+	if p := c.Parent(); p != nil {
+		pc, err := repo.GetCommit(p)
+		if err != nil {
+			return err
+		}
+		btree = pc.Tree
+	}
+	merged, conflicts, err := repo.MergeTrees(btree, hc.Tree, c.Tree, "HEAD", label)
+	if err != nil {
+		return err
+	}
+	if err := repo.applyMerge(hc.Tree, merged, conflicts); err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return &RebaseConflictError{Oid: s.Oid, Subject: c.Subject()}
+	}
+	return nil
+}
+
+// commitStep commit index as result of step in progress, if any,
+// and return the commit written, or nil if none
+func (repo *Repository) commitStep(s rebaseStep, opt RebaseOptions) ([]byte, error) {
+	if _, err := os.Stat(repo.rebasePath("stopped-sha")); os.IsNotExist(err) {
+		return nil, nil
+	}
+	ents, err := repo.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range ents {
+		if e.Conflicted {
+			return nil, fmt.Errorf("you must edit all merge conflicts and then mark them as resolved using ugit add")
+		}
+	}
+	tree, err := repo.WriteIndexTree()
+	if err != nil {
+		return nil, err
+	}
+	head, err := repo.GetOid("@")
+	if err != nil {
+		return nil, err
+	}
+	hc, err := repo.GetCommit(head)
+	if err != nil {
+		return nil, err
+	}
+	c, err := repo.GetCommit(s.Oid)
+	if err != nil {
+		return nil, err
+	}
+	committer, err := repo.GetIdent(data.Committer)
+	if err != nil {
+		return nil, err
+	}
+	nc := CommitObject{Tree: tree, Parents: [][]byte{head}, Author: c.Author, Committer: committer, Message: c.Message}
+	switch s.Cmd {
+	case "pick", "reword", "edit":
+		if bytes.Equal(tree, hc.Tree) {
+			fmt.Printf("dropping %s %s -- patch contents already upstream\n", ShortOid(s.Oid), c.Subject())
+			return nil, os.Remove(repo.rebasePath("stopped-sha"))
+		}
+		if s.Cmd == "reword" {
+			if nc.Message, err = repo.editMessage(c.Message, opt); err != nil {
+				return nil, err
+			}
+		}
+	case "squash", "fixup":
+		nc.Parents, nc.Author, nc.Message = hc.Parents, hc.Author, hc.Message
+		if s.Cmd == "squash" {
+			if nc.Message, err = repo.editMessage(hc.Message+"\n\n"+c.Message, opt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	h, err := repo.writeCommit(nc)
+	if err != nil {
+		return nil, err
+	}
+	msg := fmt.Sprintf("rebase (%s): %s", s.Cmd, nc.Subject())
+	if err := repo.UpdateRef("HEAD", data.RefValue{Symblic: false, Value: h}, false, msg); err != nil {
+		return nil, err
+	}
+	return h, os.Remove(repo.rebasePath("stopped-sha"))
+}
+
+// editMessage let user edit commit message. Lines starting with '#' are dropped.
+func (repo *Repository) editMessage(mes string, opt RebaseOptions) (string, error) {
+	if opt.Edit == nil {
+		return mes, nil
+	}
+	p := repo.Path("COMMIT_EDITMSG")
+	text := strings.TrimRight(mes, "\n") + "\n\n" +
+		"# Please enter the commit message for your changes. Lines starting\n" +
+		"# with '#' will be ignored, and an empty message aborts the commit.\n"
+	if err := ioutil.WriteFile(p, []byte(text), 0644); err != nil {
+		return "", err
+	}
+	if err := opt.Edit(p); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{}
+	for _, l := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(l, "#") {
+			lines = append(lines, strings.TrimRight(l, " \t"))
+		}
+	}
+	mes = strings.TrimSpace(strings.Join(lines, "\n"))
+	if len(mes) == 0 {
+		return "", fmt.Errorf("aborting commit due to empty commit message")
+	}
+	return mes, nil
+}
+
+// stopForEdit pause rebase after edit step, remembering its commit h to amend
+func (repo *Repository) stopForEdit(s rebaseStep, h []byte) error {
+	if err := repo.writeRebaseFile("amend", hex.EncodeToString(h)); err != nil {
+		return err
+	}
+	fmt.Printf("Stopped at %s...  %s\n"+
+		"Stage changes to amend the commit, or commit new ones, then run\n\n"+
+		"  ugit rebase --continue\n\n", ShortOid(s.Oid), s.Subject)
+	return nil
+}
+
+// RebaseContinue commit resolved or amended changes of stopped step,
+// and go on with the rest of todo list
+func (repo *Repository) RebaseContinue(opt RebaseOptions) error {
+	if !repo.RebaseInProgress() {
+		return fmt.Errorf("no rebase in progress")
+	}
+	if amend, err := repo.readRebaseFile("amend"); err == nil {
+		if err := repo.amendStopped(amend); err != nil {
+			return err
+		}
+		if err := os.Remove(repo.rebasePath("amend")); err != nil {
+			return err
+		}
+	}
+	done, err := repo.readTodo("done")
+	if err != nil {
+		return err
+	}
+	if len(done) > 0 {
+		if _, err := repo.commitStep(done[len(done)-1], opt); err != nil {
+			return err
+		}
+	}
+	return repo.runRebase(opt)
+}
+
+// amendStopped replace commit stopped at by edit step with index contents,
+// unless HEAD has moved on since
+func (repo *Repository) amendStopped(amend string) error {
+	head, err := repo.GetOid("@")
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(head) != amend {
+		return nil
+	}
+	hc, err := repo.GetCommit(head)
+	if err != nil {
+		return err
+	}
+	tree, err := repo.WriteIndexTree()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(tree, hc.Tree) {
+		return nil
+	}
+	committer, err := repo.GetIdent(data.Committer)
+	if err != nil {
+		return err
+	}
+	nc := CommitObject{Tree: tree, Parents: hc.Parents, Author: hc.Author, Committer: committer, Message: hc.Message}
+	h, err := repo.writeCommit(nc)
+	if err != nil {
+		return err
+	}
+	return repo.UpdateRef("HEAD", data.RefValue{Symblic: false, Value: h}, false, "rebase (amend): "+nc.Subject())
+}
+
+// RebaseSkip discard changes of stopped step, and go on with the rest of todo list
+func (repo *Repository) RebaseSkip(opt RebaseOptions) error {
+	if !repo.RebaseInProgress() {
+		return fmt.Errorf("no rebase in progress")
+	}
+	if err := repo.discardStopped(); err != nil {
+		return err
+	}
+	os.Remove(repo.rebasePath("amend"))
+	return repo.runRebase(opt)
+}
+
+// discardStopped reset index and working tree to HEAD, dropping files
+// brought in by the step in progress
+func (repo *Repository) discardStopped() error {
+	head, err := repo.GetOid("@")
+	if err != nil {
+		return err
+	}
+	hc, err := repo.GetCommit(head)
+	if err != nil {
+		return err
+	}
+	from := hc.Tree
+	if stopped, err := repo.readRebaseFile("stopped-sha"); err == nil {
+		oid, err := hex.DecodeString(stopped)
+		if err != nil {
+			return err
+		}
+		c, err := repo.GetCommit(oid)
+		if err != nil {
+			return err
+		}
+		from = c.Tree
+	}
+	if err := repo.checkoutTree(from, hc.Tree, "HEAD", CheckoutOptions{Force: true}); err != nil {
+		return err
+	}
+	if err := os.Remove(repo.rebasePath("stopped-sha")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RebaseAbort restore HEAD, index and working tree as they were before rebase
+func (repo *Repository) RebaseAbort() error {
+	if !repo.RebaseInProgress() {
+		return fmt.Errorf("no rebase in progress")
+	}
+	headName, err := repo.readRebaseFile("head-name")
+	if err != nil {
+		return err
+	}
+	orig, err := repo.readRebaseFile("orig-head")
+	if err != nil {
+		return err
+	}
+	oid, err := hex.DecodeString(orig)
+	if err != nil {
+		return err
+	}
+	if err := repo.discardStopped(); err != nil {
+		return err
+	}
+	head, err := repo.GetOid("@")
+	if err != nil {
+		return err
+	}
+	hc, err := repo.GetCommit(head)
+	if err != nil {
+		return err
+	}
+	oc, err := repo.GetCommit(oid)
+	if err != nil {
+		return err
+	}
+	if err := repo.checkoutTree(hc.Tree, oc.Tree, orig, CheckoutOptions{Force: true}); err != nil {
+		return err
+	}
+	ref := data.RefValue{Symblic: false, Value: oid}
+	if strings.HasPrefix(headName, "refs/") {
+		ref = data.RefValue{Symblic: true, Value: []byte(headName)}
+	}
+	if err := repo.UpdateRef("HEAD", ref, false, "rebase (abort): returning to "+headName); err != nil {
+		return err
+	}
+	return os.RemoveAll(repo.Path(RebaseDir))
+}
+
+// finishRebase point rebased branch at HEAD, and check it out again.
+// The branch must still be where rebase started from.
+func (repo *Repository) finishRebase() error {
+	headName, err := repo.readRebaseFile("head-name")
+	if err != nil {
+		return err
+	}
+	onto, err := repo.readRebaseFile("onto")
+	if err != nil {
+		return err
+	}
+	orig, err := repo.readRebaseFile("orig-head")
+	if err != nil {
+		return err
+	}
+	old, err := hex.DecodeString(orig)
+	if err != nil {
+		return err
+	}
+	head, err := repo.GetOid("@")
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(headName, "refs/") {
+		msg := fmt.Sprintf("rebase (finish): %s onto %s", headName, onto)
+		err := repo.CompareAndSwapRef(headName, old, data.RefValue{Symblic: false, Value: head}, false, msg)
+		if _, ok := err.(*data.RefMismatchError); ok {
+			os.RemoveAll(repo.Path(RebaseDir))
+			return fmt.Errorf("%v\n%s was updated during rebase, leaving rebased commits at detached HEAD %x",
+				err, headName, head)
+		} else if err != nil {
+			return err
+		}
+		ref := data.RefValue{Symblic: true, Value: []byte(headName)}
+		if err := repo.UpdateRef("HEAD", ref, false, "rebase (finish): returning to "+headName); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(repo.Path(RebaseDir)); err != nil {
+		return err
+	}
+	fmt.Printf("Successfully rebased and updated %s.\n", headName)
+	return nil
+}
@@ -0,0 +1,301 @@
+package base
+
+import (
+	"path/filepath"
+	"time"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// Repository is data.Repository with worktree operations
+type Repository struct {
+	*data.Repository
+}
+
+// Open open initialized repository with worktree root
+func Open(worktree string) (*Repository, error) {
+	r, err := data.Open(worktree)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{r}, nil
+}
+
+// Default get repository used by package-level functions
+func Default() *Repository {
+	return &Repository{data.Default}
+}
+
+// workPath get path of worktree file from its path relative to worktree root
+func (repo *Repository) workPath(p string) string {
+	return filepath.Join(repo.WorkTree, p)
+}
+
+// Init initialize ugit
+func Init() {
+	Default().Init()
+}
+
+// WriteTree write tree
+func WriteTree(root string) ([]byte, error) {
+	return Default().WriteTree(root)
+}
+
+// ClearDirectory clear dir
+func ClearDirectory(root string) error {
+	return Default().ClearDirectory(root)
+}
+
+// ReadTree read tree
+func ReadTree(oid []byte) error {
+	return Default().ReadTree(oid)
+}
+
+// GetTreeFiles get blob entries in tree recursively, keyed by path
+// Entry names are full paths.
+func GetTreeFiles(oid []byte) (map[string]data.Entry, error) {
+	return Default().GetTreeFiles(oid)
+}
+
+// Commit commit
+func Commit(mes string, author data.Signature) ([]byte, error) {
+	return Default().Commit(mes, author)
+}
+
+// GetCommit get commit
+func GetCommit(oid []byte) (CommitObject, error) {
+	return Default().GetCommit(oid)
+}
+
+// Checkout switch HEAD to name. Only files differing between current and target
+// trees are updated; local changes to other files and untracked files are kept.
+func Checkout(name string, opt CheckoutOptions) error {
+	return Default().Checkout(name, opt)
+}
+
+// CreateTag create lightweight tag pointing at oid
+func CreateTag(name string, oid []byte, force bool) error {
+	return Default().CreateTag(name, oid, force)
+}
+
+// CreateAnnotatedTag write tag object for oid, and point tag ref at it
+func CreateAnnotatedTag(name string, oid []byte, mes string, force bool) ([]byte, error) {
+	return Default().CreateAnnotatedTag(name, oid, mes, force)
+}
+
+// GetTag get annotated tag object
+func GetTag(oid []byte) (TagObject, error) {
+	return Default().GetTag(oid)
+}
+
+// DeleteTag delete tag ref, and return the oid it pointed at.
+// An annotated tag object is left for prune.
+func DeleteTag(name string) ([]byte, error) {
+	return Default().DeleteTag(name)
+}
+
+// ListTags get sorted tag names matching glob pattern, all tags for empty pattern
+func ListTags(pattern string) ([]string, error) {
+	return Default().ListTags(pattern)
+}
+
+// PrintTag print annotated tag header and message
+func PrintTag(oid []byte) error {
+	return Default().PrintTag(oid)
+}
+
+// GetDecorations get ref names pointing at each object keyed by hex oid,
+// with annotated tags listed at the object they point to
+func GetDecorations() (map[string][]string, error) {
+	return Default().GetDecorations()
+}
+
+// Peel dereference tags, and commits into trees, until an object of type t.
+// With None, only tags are dereferenced.
+func Peel(oid []byte, t data.Type) ([]byte, error) {
+	return Default().Peel(oid, t)
+}
+
+// GetOid resolve revision expression into oid. Supported are
+// `@`, ref names, full or unique abbreviated oids, `@{-n}`, `ref@{n}`, `ref@{date}`, `:/regexp`,
+// followed by any of `~n`, `^n` and `^{type}`.
+func GetOid(rev string) ([]byte, error) {
+	return Default().GetOid(rev)
+}
+
+// ParseRange parse `a..b` or `a...b`, an omitted end meaning HEAD.
+// Ends are peeled to commits. ok is false when rev is not a range.
+func ParseRange(rev string) (RevRange, bool, error) {
+	return Default().ParseRange(rev)
+}
+
+// GetReflog get full name of ref and its reflog, oldest first.
+// An empty ref means the current branch.
+func GetReflog(ref string) (string, []data.ReflogEntry, error) {
+	return Default().GetReflog(ref)
+}
+
+// GetRangeCommits get commits in range, in the order of GetCommitsAndParents
+func GetRangeCommits(r RevRange) ([][]byte, error) {
+	return Default().GetRangeCommits(r)
+}
+
+// GetCommitsAndParents get commits and parents
+func GetCommitsAndParents(oidset [][]byte) ([][]byte, error) {
+	return Default().GetCommitsAndParents(oidset)
+}
+
+// CreateBranch create branch
+func CreateBranch(name string, oid []byte) error {
+	return Default().CreateBranch(name, oid)
+}
+
+// GetBranchName get branch
+func GetBranchName() (string, error) {
+	return Default().GetBranchName()
+}
+
+// GetBranchNames get branch list
+func GetBranchNames() ([]string, error) {
+	return Default().GetBranchNames()
+}
+
+// IsAncestor report whether commit a is reachable from commit b
+func IsAncestor(a, b []byte) (bool, error) {
+	return Default().IsAncestor(a, b)
+}
+
+// DeleteBranch delete branch, and return the oid it pointed at.
+// A branch not merged into HEAD is kept unless forced.
+func DeleteBranch(name string, force bool) ([]byte, error) {
+	return Default().DeleteBranch(name, force)
+}
+
+// RenameBranch rename branch old to new with its reflog, and follow it with HEAD.
+// An existing branch new is replaced only if forced.
+func RenameBranch(old, new string, force bool) error {
+	return Default().RenameBranch(old, new, force)
+}
+
+// PrintCommit print commit
+func PrintCommit(oid []byte, refs []string) error {
+	return Default().PrintCommit(oid, refs)
+}
+
+// Migrate rewrite legacy trees, and commits pointing at them, reachable from refs
+func Migrate() ([]string, error) {
+	return Default().Migrate()
+}
+
+// Fsck verify hashes and structure of every object, and targets of every ref
+func Fsck() (*FsckReport, error) {
+	return Default().Fsck()
+}
+
+// GetReachableObjects get every object reachable from oids,
+// following tags, commit parents and trees down to blobs
+func GetReachableObjects(oids [][]byte) ([][]byte, error) {
+	return Default().GetReachableObjects(oids)
+}
+
+// GetPruneExpire get grace period from gc.pruneExpire config
+func GetPruneExpire() (time.Duration, error) {
+	return Default().GetPruneExpire()
+}
+
+// Prune delete unreachable loose objects older than expire, and return them.
+// With dryRun, objects are only listed.
+func Prune(expire time.Duration, dryRun bool) ([][]byte, error) {
+	return Default().Prune(expire, dryRun)
+}
+
+// GC pack refs and reachable loose objects, deleting their loose copies,
+// then prune unreachable loose objects older than gc.pruneExpire
+func GC() error {
+	return Default().GC()
+}
+
+// Add stage files and directories into index
+func Add(paths []string) error {
+	return Default().Add(paths)
+}
+
+// Remove unstage files, and delete them from working tree unless cached
+func Remove(paths []string, cached bool) error {
+	return Default().Remove(paths, cached)
+}
+
+// ResetPaths reset index entries of paths to commit's version
+func ResetPaths(oid []byte, paths []string) error {
+	return Default().ResetPaths(oid, paths)
+}
+
+// Reset move HEAD, or the branch it points at, to commit oid, and reset index
+// and working tree as mode says. The previous HEAD is saved in ORIG_HEAD.
+func Reset(oid []byte, mode ResetMode, msg string) error {
+	return Default().Reset(oid, mode, msg)
+}
+
+// ResetIndex replace index with tree's files, leaving working tree alone
+func ResetIndex(tree []byte) error {
+	return Default().ResetIndex(tree)
+}
+
+// WriteIndexTree write tree from index
+func WriteIndexTree() ([]byte, error) {
+	return Default().WriteIndexTree()
+}
+
+// GetMergeBase get best common ancestor of two commits, or nil if unrelated.
+// A common ancestor is best when it is not an ancestor of another common ancestor.
+func GetMergeBase(a, b []byte) ([]byte, error) {
+	return Default().GetMergeBase(a, b)
+}
+
+// MergeTrees merge ours and theirs trees against base tree.
+// It returns merged blob entries keyed by path, and paths left with conflicts.
+func MergeTrees(btree, otree, ttree []byte, oursLabel, theirsLabel string) (map[string]data.Entry, []string, error) {
+	return Default().MergeTrees(btree, otree, ttree, oursLabel, theirsLabel)
+}
+
+// Merge merge commit into HEAD
+func Merge(name string, author data.Signature) error {
+	return Default().Merge(name, author)
+}
+
+// Status compare HEAD, index and working tree without writing any object
+func Status() ([]FileStatus, error) {
+	return Default().Status()
+}
+
+// LoadIgnore load repository exclude file; .ugitignore files are read as paths are matched
+func LoadIgnore() (*Ignore, error) {
+	return Default().LoadIgnore()
+}
+
+// RebaseInProgress report whether a rebase is stopped, waiting for --continue
+func RebaseInProgress() bool {
+	return Default().RebaseInProgress()
+}
+
+// Rebase replay commits of HEAD not in upstream onto upstream, one by one.
+// It stops on conflicts, and on edit steps, until RebaseContinue.
+func Rebase(upstream string, opt RebaseOptions) error {
+	return Default().Rebase(upstream, opt)
+}
+
+// RebaseContinue commit resolved or amended changes of stopped step,
+// and go on with the rest of todo list
+func RebaseContinue(opt RebaseOptions) error {
+	return Default().RebaseContinue(opt)
+}
+
+// RebaseSkip discard changes of stopped step, and go on with the rest of todo list
+func RebaseSkip(opt RebaseOptions) error {
+	return Default().RebaseSkip(opt)
+}
+
+// RebaseAbort restore HEAD, index and working tree as they were before rebase
+func RebaseAbort() error {
+	return Default().RebaseAbort()
+}
@@ -0,0 +1,79 @@
+package base
+
+import (
+	"fmt"
+	"os"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// ResetMode is how much of index and working tree Reset brings to the commit
+type ResetMode int
+
+const (
+	// ResetSoft move HEAD only
+	ResetSoft ResetMode = iota
+	// ResetMixed move HEAD and reset index, keeping working tree
+	ResetMixed
+	// ResetHard move HEAD and reset index and working tree, discarding local changes
+	ResetHard
+)
+
+func (m ResetMode) String() string {
+	switch m {
+	case ResetSoft:
+		return "soft"
+	case ResetMixed:
+		return "mixed"
+	case ResetHard:
+		return "hard"
+	}
+	return "unknown"
+}
+
+// Reset move HEAD, or the branch it points at, to commit oid, and reset index
+// and working tree as mode says. The previous HEAD is saved in ORIG_HEAD.
+func (repo *Repository) Reset(oid []byte, mode ResetMode, msg string) error {
+	c, err := repo.GetCommit(oid)
+	if err != nil {
+		return err
+	}
+	merging := repo.HasRef("MERGE_HEAD")
+	if mode == ResetSoft && merging {
+		return fmt.Errorf("cannot do a soft reset in the middle of a merge")
+	}
+	var htree []byte
+	head, err := repo.GetOid("@")
+	if err == nil {
+		hc, err := repo.GetCommit(head)
+		if err != nil {
+			return err
+		}
+		htree = hc.Tree
+	}
+	switch mode {
+	case ResetMixed:
+		if err := repo.ResetIndex(c.Tree); err != nil {
+			return err
+		}
+	case ResetHard:
+		if err := repo.checkoutTree(htree, c.Tree, "reset", CheckoutOptions{Force: true, RemoveStaged: true}); err != nil {
+			return err
+		}
+	}
+	if len(head) > 0 {
+		if err := repo.UpdateRef("ORIG_HEAD", data.RefValue{Symblic: false, Value: head}, false, ""); err != nil {
+			return err
+		}
+	}
+	if err := repo.UpdateRef("HEAD", data.RefValue{Symblic: false, Value: oid}, true, msg); err != nil {
+		return err
+	}
+	if merging {
+		if err := repo.DeleteRef("MERGE_HEAD", false); err != nil {
+			return err
+		}
+		os.Remove(repo.Path("MERGE_MSG"))
+	}
+	return nil
+}
@@ -0,0 +1,510 @@
+package base
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// minAbbrev is the shortest hex prefix accepted as an abbreviated oid
+const minAbbrev = 4
+
+// shortLen is length of abbreviated oids in messages
+const shortLen = 7
+
+var hexPattern = regexp.MustCompile("^[0-9a-fA-F]+$")
+
+// AmbiguousError is returned when an abbreviated oid matches several objects
+type AmbiguousError struct {
+	Prefix     string
+	Candidates []string
+}
+
+func (e *AmbiguousError) Error() string {
+	s := fmt.Sprintf("short object ID %s is ambiguous\nhint: The candidates are:", e.Prefix)
+	for _, c := range e.Candidates {
+		s += fmt.Sprintf("\nhint:   %s", c)
+	}
+	return s
+}
+
+// GetOid resolve revision expression into oid. Supported are
+// `@`, ref names, full or unique abbreviated oids, `@{-n}`, `ref@{n}`, `ref@{date}`, `:/regexp`,
+// followed by any of `~n`, `^n` and `^{type}`.
+func (repo *Repository) GetOid(rev string) ([]byte, error) {
+	if strings.HasPrefix(rev, ":/") {
+		return repo.searchCommit(rev[2:])
+	}
+	i := strings.IndexAny(rev, "~^")
+	if i < 0 {
+		i = len(rev)
+	}
+	oid, err := repo.resolveName(rev[:i])
+	if err != nil {
+		return nil, err
+	}
+	for s := rev[i:]; len(s) > 0; {
+		op := s[0]
+		s = s[1:]
+		if op == '^' && strings.HasPrefix(s, "{") {
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid revision %s: missing '}'", rev)
+			}
+			if oid, err = repo.peel(rev, oid, s[1:end]); err != nil {
+				return nil, err
+			}
+			s = s[end+1:]
+			continue
+		}
+		if op != '^' && op != '~' {
+			return nil, fmt.Errorf("invalid revision %s", rev)
+		}
+		j := 0
+		for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			j++
+		}
+		n := 1
+		if j > 0 {
+			if n, err = strconv.Atoi(s[:j]); err != nil {
+				return nil, fmt.Errorf("invalid revision %s: %v", rev, err)
+			}
+		}
+		s = s[j:]
+		if op == '~' {
+			oid, err = repo.ancestor(rev, oid, n)
+		} else {
+			oid, err = repo.parent(rev, oid, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return oid, nil
+}
+
+// resolveName resolve revision without suffixes
+func (repo *Repository) resolveName(name string) ([]byte, error) {
+	if len(name) == 0 {
+		return nil, fmt.Errorf("invalid revision: empty name")
+	}
+	if name == "@" {
+		name = "HEAD"
+	}
+	if prev, ok, err := repo.expandPrevious(name); ok {
+		if err != nil {
+			return nil, err
+		}
+		return repo.resolveName(prev)
+	}
+	if i := strings.Index(name, "@{"); i >= 0 && strings.HasSuffix(name, "}") {
+		return repo.resolveReflog(name[:i], name[i+2:len(name)-1])
+	}
+	if len(name) == 2*sha1.Size && hexPattern.MatchString(name) {
+		return hex.DecodeString(name)
+	}
+	refs := repo.matchRefs(name)
+	if len(refs) > 1 {
+		fmt.Fprintf(os.Stderr, "warning: refname '%s' is ambiguous.\n", name)
+	}
+	if len(refs) > 0 {
+		r, err := repo.GetRef(refs[0], true)
+		if err != nil && refs[0] == "HEAD" {
+			return nil, fmt.Errorf("ugit is empty")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Value) == 0 {
+			return nil, fmt.Errorf("ref %s does not point to a commit", refs[0])
+		}
+		return r.Value, nil
+	}
+	if name == "HEAD" {
+		return nil, fmt.Errorf("ugit is empty")
+	}
+	if len(name) >= minAbbrev && hexPattern.MatchString(name) {
+		return repo.resolveAbbrev(name)
+	}
+	return nil, fmt.Errorf("unknown revision %s", name)
+}
+
+// resolveReflog get value of ref from its reflog, `n` entries ago or as of date.
+// An empty ref means the current branch.
+func (repo *Repository) resolveReflog(ref, spec string) ([]byte, error) {
+	full, ents, err := repo.GetReflog(ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(ents) == 0 {
+		return nil, fmt.Errorf("log for %s is empty", full)
+	}
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 0 || n >= len(ents) {
+			return nil, fmt.Errorf("log for %s only has %d entries", full, len(ents))
+		}
+		return ents[len(ents)-1-n].New, nil
+	}
+	t, err := parseApproxDate(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid revision %s@{%s}: %v", ref, spec, err)
+	}
+	for i := len(ents) - 1; i >= 0; i-- {
+		if !ents[i].Who.When.After(t) {
+			return ents[i].New, nil
+		}
+	}
+	if data.IsZeroOid(ents[0].Old) {
+		return nil, fmt.Errorf("log for %s only goes back to %s", full, ents[0].Who.When.Format(dateFormat))
+	}
+	return ents[0].Old, nil
+}
+
+// GetReflog get full name of ref and its reflog, oldest first.
+// An empty ref means the current branch.
+func (repo *Repository) GetReflog(ref string) (string, []data.ReflogEntry, error) {
+	full := "HEAD"
+	if len(ref) == 0 {
+		if b, err := repo.GetBranchName(); err == nil && len(b) > 0 {
+			full = b
+		}
+	} else if ref != "@" {
+		refs := repo.matchRefs(ref)
+		if len(refs) == 0 {
+			return "", nil, fmt.Errorf("unknown revision %s", ref)
+		}
+		full = refs[0]
+	}
+	ents, err := repo.ReadReflog(full)
+	if err != nil {
+		return "", nil, err
+	}
+	return full, ents, nil
+}
+
+// parseApproxDate parse date such as `yesterday`, `2.days.ago`, `1 hour ago` or an absolute date
+func parseApproxDate(s string) (time.Time, error) {
+	if s == "yesterday" {
+		return time.Now().Add(-24 * time.Hour), nil
+	}
+	if d, err := ParseExpire(strings.ReplaceAll(s, " ", ".")); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return data.ParseDate(s)
+}
+
+// matchRefs get existing refs which name may refer to, in order of precedence
+func (repo *Repository) matchRefs(name string) []string {
+	if strings.HasPrefix(name, "/") || strings.Contains(name, "..") {
+		return nil
+	}
+	prefixs := []string{
+		"refs/",
+		"refs/tags/",
+		"refs/heads/",
+	}
+	// only upper case names like HEAD or MERGE_HEAD, and full ref names,
+	// live directly in .ugit
+	if strings.HasPrefix(name, "refs/") || strings.ToUpper(name) == name && !strings.Contains(name, "/") {
+		prefixs = append([]string{""}, prefixs...)
+	}
+	refs := []string{}
+	for _, p := range prefixs {
+		if ref := p + name; repo.HasRef(ref) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// resolveAbbrev find the only object whose oid starts with prefix
+func (repo *Repository) resolveAbbrev(prefix string) ([]byte, error) {
+	oids, err := repo.FindObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	switch len(oids) {
+	case 0:
+		return nil, fmt.Errorf("unknown revision %s", prefix)
+	case 1:
+		return oids[0], nil
+	}
+	e := &AmbiguousError{Prefix: prefix}
+	for _, oid := range oids {
+		t, err := repo.GetType(oid)
+		if err != nil {
+			return nil, err
+		}
+		n := len(prefix) + 1
+		if n < shortLen {
+			n = shortLen
+		}
+		if n > 2*sha1.Size {
+			n = 2 * sha1.Size
+		}
+		e.Candidates = append(e.Candidates, fmt.Sprintf("%s %s", hex.EncodeToString(oid)[:n], t))
+	}
+	return nil, e
+}
+
+// ShortOid abbreviate oid for display
+func ShortOid(oid []byte) string {
+	return hex.EncodeToString(oid)[:shortLen]
+}
+
+// peel dereference oid until object of type name, `^{}` peeling tags only
+func (repo *Repository) peel(rev string, oid []byte, name string) ([]byte, error) {
+	t := data.None
+	if len(name) > 0 {
+		var err error
+		if t, err = data.ParseType(name); err != nil {
+			return nil, fmt.Errorf("invalid revision %s: %v", rev, err)
+		}
+	}
+	oid, err := repo.Peel(oid, t)
+	if err != nil && len(rev) > 0 {
+		return nil, fmt.Errorf("%s: %v", rev, err)
+	}
+	return oid, err
+}
+
+// Peel dereference tags, and commits into trees, until an object of type t.
+// With None, only tags are dereferenced.
+func (repo *Repository) Peel(oid []byte, t data.Type) ([]byte, error) {
+	for {
+		ot, err := repo.GetType(oid)
+		if err != nil {
+			return nil, err
+		}
+		if ot == t || (t == data.None && ot != data.Tag) {
+			return oid, nil
+		}
+		switch {
+		case ot == data.Tag:
+			tag, err := repo.GetTag(oid)
+			if err != nil {
+				return nil, err
+			}
+			oid = tag.Object
+		case ot == data.Commit && t == data.Tree:
+			c, err := repo.GetCommit(oid)
+			if err != nil {
+				return nil, err
+			}
+			return c.Tree, nil
+		default:
+			return nil, fmt.Errorf("expected %s type, but the object dereferences to %s type", t, ot)
+		}
+	}
+}
+
+// parent get nth parent, `^0` being the commit itself
+func (repo *Repository) parent(rev string, oid []byte, n int) ([]byte, error) {
+	oid, err := repo.peel(rev, oid, data.Commit.String())
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return oid, nil
+	}
+	c, err := repo.GetCommit(oid)
+	if err != nil {
+		return nil, err
+	}
+	if n > len(c.Parents) {
+		return nil, fmt.Errorf("%s: commit %s has no parent %d", rev, ShortOid(oid), n)
+	}
+	return c.Parents[n-1], nil
+}
+
+// ancestor follow first parents n times
+func (repo *Repository) ancestor(rev string, oid []byte, n int) ([]byte, error) {
+	oid, err := repo.peel(rev, oid, data.Commit.String())
+	if err != nil {
+		return nil, err
+	}
+	for ; n > 0; n-- {
+		c, err := repo.GetCommit(oid)
+		if err != nil {
+			return nil, err
+		}
+		if len(c.Parents) == 0 {
+			return nil, fmt.Errorf("%s: commit %s has no parent", rev, ShortOid(oid))
+		}
+		oid = c.Parents[0]
+	}
+	return oid, nil
+}
+
+// searchCommit find the youngest commit reachable from any ref whose message matches pattern
+func (repo *Repository) searchCommit(pattern string) ([]byte, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid revision :/%s: %v", pattern, err)
+	}
+	names, err := repo.ListRefNames()
+	if err != nil {
+		return nil, err
+	}
+	roots := [][]byte{}
+	for _, name := range append([]string{"HEAD"}, names...) {
+		r, err := repo.GetRef(name, true)
+		if err != nil || len(r.Value) == 0 {
+			continue
+		}
+		if oid, err := repo.Peel(r.Value, data.Commit); err == nil {
+			roots = append(roots, oid)
+		}
+	}
+	oids, err := repo.GetCommitsAndParents(roots)
+	if err != nil {
+		return nil, err
+	}
+	commits := make([]CommitObject, len(oids))
+	for i, oid := range oids {
+		if commits[i], err = repo.GetCommit(oid); err != nil {
+			return nil, err
+		}
+	}
+	idx := make([]int, len(oids))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return commits[idx[i]].Committer.When.After(commits[idx[j]].Committer.When)
+	})
+	for _, i := range idx {
+		if re.MatchString(commits[i].Message) {
+			return oids[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no commit message matches %s", pattern)
+}
+
+// RevRange is commits reachable from To but not from From.
+// Symmetric ranges `a...b` hold commits reachable from either but not both.
+type RevRange struct {
+	From      []byte
+	To        []byte
+	Symmetric bool
+}
+
+// ParseRange parse `a..b` or `a...b`, an omitted end meaning HEAD.
+// Ends are peeled to commits. ok is false when rev is not a range.
+func (repo *Repository) ParseRange(rev string) (r RevRange, ok bool, err error) {
+	if strings.HasPrefix(rev, ":/") {
+		return RevRange{}, false, nil
+	}
+	sep := "..."
+	i := strings.Index(rev, sep)
+	if i < 0 {
+		sep = ".."
+		i = strings.Index(rev, sep)
+	}
+	if i < 0 {
+		return RevRange{}, false, nil
+	}
+	from, to := rev[:i], rev[i+len(sep):]
+	if len(from) == 0 {
+		from = "@"
+	}
+	if len(to) == 0 {
+		to = "@"
+	}
+	for _, end := range []struct {
+		rev string
+		oid *[]byte
+	}{{from, &r.From}, {to, &r.To}} {
+		oid, err := repo.GetOid(end.rev)
+		if err != nil {
+			return RevRange{}, true, err
+		}
+		if *end.oid, err = repo.peel(end.rev, oid, data.Commit.String()); err != nil {
+			return RevRange{}, true, err
+		}
+	}
+	r.Symmetric = sep == "..."
+	return r, true, nil
+}
+
+// GetRangeCommits get commits in range, in the order of GetCommitsAndParents
+func (repo *Repository) GetRangeCommits(r RevRange) ([][]byte, error) {
+	from, to := r.From, r.To
+	include, exclude := [][]byte{to}, [][]byte{from}
+	if r.Symmetric {
+		include = append(include, from)
+		base, err := repo.GetMergeBase(from, to)
+		if err != nil {
+			return nil, err
+		}
+		exclude = nil
+		if base != nil {
+			exclude = [][]byte{base}
+		}
+	}
+	excluded, err := repo.GetCommitsAndParents(exclude)
+	if err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{}
+	for _, oid := range excluded {
+		skip[string(oid)] = true
+	}
+	oids, err := repo.GetCommitsAndParents(include)
+	if err != nil {
+		return nil, err
+	}
+	res := [][]byte{}
+	for _, oid := range oids {
+		if !skip[string(oid)] {
+			res = append(res, oid)
+		}
+	}
+	return res, nil
+}
+
+// expandPrevious expand `@{-n}` into the branch or oid checked out before the nth last checkout.
+// ok is false when name is not of that form.
+func (repo *Repository) expandPrevious(name string) (prev string, ok bool, err error) {
+	if !strings.HasPrefix(name, "@{-") || !strings.HasSuffix(name, "}") {
+		return "", false, nil
+	}
+	n, err := strconv.Atoi(name[3 : len(name)-1])
+	if err != nil || n < 1 {
+		return "", true, fmt.Errorf("invalid revision %s", name)
+	}
+	prev, err = repo.previousCheckout(n)
+	return prev, true, err
+}
+
+// previousCheckout get branch or oid checked out before the nth last checkout, from HEAD reflog
+func (repo *Repository) previousCheckout(n int) (string, error) {
+	ents, err := repo.ReadReflog("HEAD")
+	if err != nil {
+		return "", err
+	}
+	const prefix = "checkout: moving from "
+	for i := len(ents) - 1; i >= 0; i-- {
+		msg := ents[i].Message
+		if !strings.HasPrefix(msg, prefix) {
+			continue
+		}
+		if n--; n > 0 {
+			continue
+		}
+		move := msg[len(prefix):]
+		if j := strings.LastIndex(move, " to "); j >= 0 {
+			return move[:j], nil
+		}
+		return "", fmt.Errorf("invalid checkout entry %q in HEAD reflog", msg)
+	}
+	return "", fmt.Errorf("not enough checkouts in HEAD reflog")
+}
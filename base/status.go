@@ -0,0 +1,156 @@
+package base
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// FileStatus is status of a path, in `git status --porcelain` letters
+type FileStatus struct {
+	Path     string
+	Staged   byte
+	Unstaged byte
+}
+
+// Status compare HEAD, index and working tree without writing any object
+func (repo *Repository) Status() ([]FileStatus, error) {
+	hfiles := map[string]data.Entry{}
+	if head, err := repo.GetOid("@"); err == nil {
+		c, err := repo.GetCommit(head)
+		if err != nil {
+			return nil, err
+		}
+		if hfiles, err = repo.GetTreeFiles(c.Tree); err != nil {
+			return nil, err
+		}
+	}
+	ents, err := repo.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	sts := map[string]*FileStatus{}
+	get := func(p string) *FileStatus {
+		if st, ok := sts[p]; ok {
+			return st
+		}
+		st := &FileStatus{Path: p, Staged: ' ', Unstaged: ' '}
+		sts[p] = st
+		return st
+	}
+
+	tracked := map[string]bool{}
+	for _, e := range ents {
+		tracked[e.Path] = true
+		for d := filepath.Dir(e.Path); d != "."; d = filepath.Dir(d) {
+			tracked[filepath.ToSlash(d)+"/"] = true
+		}
+		if e.Conflicted {
+			st := get(e.Path)
+			st.Staged, st.Unstaged = 'U', 'U'
+			continue
+		}
+		ho, ok := hfiles[e.Path]
+		if !ok {
+			get(e.Path).Staged = 'A'
+		} else if !bytes.Equal(ho.Oid, e.Oid) || ho.Mode != e.Mode {
+			get(e.Path).Staged = 'M'
+		}
+		changed, err := repo.isModified(e)
+		if os.IsNotExist(err) {
+			get(e.Path).Unstaged = 'D'
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			get(e.Path).Unstaged = 'M'
+		}
+	}
+	for p := range hfiles {
+		if !tracked[p] {
+			get(p).Staged = 'D'
+		}
+	}
+
+	ig, err := repo.LoadIgnore()
+	if err != nil {
+		return nil, err
+	}
+	untracked := ""
+	err = filepath.Walk(repo.WorkTree, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path, err = filepath.Rel(repo.WorkTree, path); err != nil {
+			return err
+		}
+		path = cleanPath(path)
+		if path == "." {
+			return nil
+		}
+		if ig.IsIgnored(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if !tracked[path+"/"] && (len(untracked) == 0 || !isUnder(path, untracked)) {
+				untracked = path
+			}
+			return nil
+		}
+		if !tracked[path] {
+			// untracked directories are listed once, if they hold any file not ignored
+			p := path
+			if len(untracked) > 0 && isUnder(path, untracked) {
+				p = untracked + "/"
+			}
+			st := get(p)
+			st.Staged, st.Unstaged = '?', '?'
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]FileStatus, 0, len(sts))
+	for _, st := range sts {
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Path < res[j].Path
+	})
+	return res, nil
+}
+
+// isModified report whether working tree file differs from index entry.
+// Files whose stat data matches the entry are not read.
+func (repo *Repository) isModified(e data.IndexEntry) (bool, error) {
+	fi, err := os.Lstat(repo.workPath(e.Path))
+	if err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		return false, &os.PathError{Op: "lstat", Path: e.Path, Err: os.ErrNotExist}
+	}
+	cur := data.NewIndexEntry(e.Path, e.Oid, fi)
+	if cur.Mode != e.Mode {
+		return true, nil
+	}
+	if cur.Size == e.Size && cur.Mtime == e.Mtime && cur.Ctime == e.Ctime && cur.Ino == e.Ino {
+		return false, nil
+	}
+	dat, err := repo.readWorkFile(e.Path, fi)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(data.Hash(dat, data.Blob), e.Oid), nil
+}
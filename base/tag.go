@@ -0,0 +1,189 @@
+package base
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+// TagObject is parsed annotated tag
+type TagObject struct {
+	Object  []byte
+	Type    data.Type
+	Name    string
+	Tagger  data.Signature
+	Message string
+}
+
+// tagRef get ref name of tag
+func tagRef(name string) string {
+	return fmt.Sprintf("refs/tags/%s", name)
+}
+
+// CreateTag create lightweight tag pointing at oid
+func (repo *Repository) CreateTag(name string, oid []byte, force bool) error {
+	return repo.updateTag(name, oid, force, "tag: tagging "+hex.EncodeToString(oid))
+}
+
+// CreateAnnotatedTag write tag object for oid, and point tag ref at it
+func (repo *Repository) CreateAnnotatedTag(name string, oid []byte, mes string, force bool) ([]byte, error) {
+	t, err := repo.GetType(oid)
+	if err != nil {
+		return nil, err
+	}
+	tagger, err := repo.GetIdent(data.Committer)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(mes, "\n") {
+		mes += "\n"
+	}
+	tag := TagObject{Object: oid, Type: t, Name: name, Tagger: tagger, Message: mes}
+	h, err := repo.writeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.updateTag(name, h, force, "tag: tagging "+hex.EncodeToString(oid)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// updateTag point tag ref at oid, refusing to replace an existing tag unless forced
+func (repo *Repository) updateTag(name string, oid []byte, force bool, msg string) error {
+	var old []byte
+	if !force {
+		old = make([]byte, sha1.Size)
+	}
+	err := repo.CompareAndSwapRef(tagRef(name), old, data.RefValue{Symblic: false, Value: oid}, true, msg)
+	if _, ok := err.(*data.RefMismatchError); ok {
+		return fmt.Errorf("tag '%s' already exists", name)
+	}
+	return err
+}
+
+func (repo *Repository) writeTag(t TagObject) ([]byte, error) {
+	dat := fmt.Sprintf("object %x\n", t.Object)
+	dat += fmt.Sprintf("type %s\n", t.Type)
+	dat += fmt.Sprintf("tag %s\n", t.Name)
+	dat += fmt.Sprintf("tagger %s\n", t.Tagger)
+	dat += fmt.Sprintf("\n%s", t.Message)
+	return repo.HashObject([]byte(dat), data.Tag)
+}
+
+// GetTag get annotated tag object
+func (repo *Repository) GetTag(oid []byte) (TagObject, error) {
+	b, err := repo.GetObject(oid, data.Tag)
+	if err != nil {
+		return TagObject{}, err
+	}
+	t := TagObject{}
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return TagObject{}, fmt.Errorf("invalid tag %x: missing message", oid)
+		}
+		line := string(b[:i])
+		b = b[i+1:]
+		if len(line) == 0 {
+			break
+		}
+		kv := strings.SplitN(line, " ", 2)
+		if len(kv) != 2 {
+			return TagObject{}, fmt.Errorf("invalid tag %x: bad header %q", oid, line)
+		}
+		switch kv[0] {
+		case "object":
+			if t.Object, err = hex.DecodeString(kv[1]); err != nil {
+				return TagObject{}, fmt.Errorf("invalid tag %x: %v", oid, err)
+			}
+		case "type":
+			if t.Type, err = data.ParseType(kv[1]); err != nil {
+				return TagObject{}, fmt.Errorf("invalid tag %x: %v", oid, err)
+			}
+		case "tag":
+			t.Name = kv[1]
+		case "tagger":
+			if t.Tagger, err = data.ParseSignature(kv[1]); err != nil {
+				return TagObject{}, fmt.Errorf("invalid tag %x: %v", oid, err)
+			}
+		}
+	}
+	if len(t.Object) != sha1.Size {
+		return TagObject{}, fmt.Errorf("invalid tag %x: missing object", oid)
+	}
+	t.Message = string(b)
+	return t, nil
+}
+
+// DeleteTag delete tag ref, and return the oid it pointed at.
+// An annotated tag object is left for prune.
+func (repo *Repository) DeleteTag(name string) ([]byte, error) {
+	r, err := repo.GetRef(tagRef(name), false)
+	if err != nil || r.Symblic {
+		return nil, fmt.Errorf("tag '%s' not found", name)
+	}
+	if err := repo.CompareAndDeleteRef(tagRef(name), r.Value, false); err != nil {
+		return nil, err
+	}
+	return r.Value, nil
+}
+
+// ListTags get sorted tag names matching glob pattern, all tags for empty pattern.
+// As in git, `*` in pattern matches '/' too.
+func (repo *Repository) ListTags(pattern string) ([]string, error) {
+	names, _, err := repo.GetRefs("refs/tags/", false)
+	if err != nil {
+		return nil, err
+	}
+	re, err := compileRefGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, n := range names {
+		n = strings.TrimPrefix(n, "refs/tags/")
+		if len(pattern) > 0 && !re.MatchString(n) {
+			continue
+		}
+		tags = append(tags, n)
+	}
+	return tags, nil
+}
+
+// PrintTag print annotated tag header and message
+func (repo *Repository) PrintTag(oid []byte) error {
+	t, err := repo.GetTag(oid)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("tag     %s\ntagger  %s\ndate    %s\n", t.Name, t.Tagger.Ident(), t.Tagger.When.Format(dateFormat))
+	mes := strings.ReplaceAll(strings.TrimRight(t.Message, "\n"), "\n", "\n        ")
+	fmt.Printf("message %s\n\n", mes)
+	return nil
+}
+
+// GetDecorations get ref names pointing at each object keyed by hex oid,
+// with annotated tags listed at the object they point to
+func (repo *Repository) GetDecorations() (map[string][]string, error) {
+	names, refs, err := repo.GetRefs("", true)
+	if err != nil {
+		return nil, err
+	}
+	decos := map[string][]string{}
+	for i, ref := range refs {
+		oid := ref.Value
+		if strings.HasPrefix(names[i], "refs/tags/") {
+			if oid, err = repo.Peel(oid, data.None); err != nil {
+				return nil, err
+			}
+		}
+		key := hex.EncodeToString(oid)
+		decos[key] = append(decos[key], names[i])
+	}
+	return decos, nil
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GetConfig get config value from repository config, then ~/.ugitconfig
+func (repo *Repository) GetConfig(key string) (string, error) {
+	paths := []string{repo.Path("config")}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".ugitconfig"))
+	}
+	for _, p := range paths {
+		conf, err := readConfig(p)
+		if err != nil {
+			continue
+		}
+		for _, kv := range conf {
+			if kv[0] == key {
+				return kv[1], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("config %s is not set", key)
+}
+
+// SetConfig set config value in repository config
+func (repo *Repository) SetConfig(key, value string) error {
+	p := repo.Path("config")
+	conf, err := readConfig(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	found := false
+	for i, kv := range conf {
+		if kv[0] == key {
+			conf[i][1] = value
+			found = true
+		}
+	}
+	if !found {
+		conf = append(conf, [2]string{key, value})
+	}
+	return writeConfig(p, conf)
+}
+
+func splitConfigKey(key string) (string, string) {
+	i := strings.LastIndexByte(key, '.')
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+func readConfig(path string) ([][2]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := [][2]string{}
+	section := ""
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid config line %q in %s", line, path)
+		}
+		key := strings.TrimSpace(kv[0])
+		if len(section) > 0 {
+			key = fmt.Sprintf("%s.%s", section, key)
+		}
+		conf = append(conf, [2]string{key, strings.TrimSpace(kv[1])})
+	}
+	return conf, sc.Err()
+}
+
+func writeConfig(path string, conf [][2]string) error {
+	sections := []string{}
+	keys := map[string][][2]string{}
+	for _, kv := range conf {
+		s, k := splitConfigKey(kv[0])
+		if _, ok := keys[s]; !ok {
+			sections = append(sections, s)
+		}
+		keys[s] = append(keys[s], [2]string{k, kv[1]})
+	}
+	out := ""
+	for _, s := range sections {
+		if len(s) > 0 {
+			out += fmt.Sprintf("[%s]\n", s)
+		}
+		for _, kv := range keys[s] {
+			out += fmt.Sprintf("\t%s = %s\n", kv[0], kv[1])
+		}
+	}
+	return ioutil.WriteFile(path, []byte(out), 0644)
+}
@@ -3,10 +3,14 @@ package data
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -22,8 +26,35 @@ const (
 	Tree
 	// Commit type
 	Commit
+	// Tag type, for annotated tags
+	Tag
 )
 
+// String get type name
+func (t Type) String() string {
+	switch t {
+	case Blob:
+		return "blob"
+	case Tree:
+		return "tree"
+	case Commit:
+		return "commit"
+	case Tag:
+		return "tag"
+	}
+	return "none"
+}
+
+// ParseType get type from its name
+func ParseType(name string) (Type, error) {
+	for _, t := range []Type{Blob, Tree, Commit, Tag} {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	return None, fmt.Errorf("unknown object type %s", name)
+}
+
 // GITDIR is git directory
 const GITDIR = ".ugit"
 
@@ -31,6 +62,7 @@ const GITDIR = ".ugit"
 type Entry struct {
 	Oid  []byte
 	Name string
+	Mode uint32
 }
 
 // RefValue is ref container
@@ -40,44 +72,73 @@ type RefValue struct {
 }
 
 // Init initialize .ugit
-func Init() error {
-	if err := os.MkdirAll(GITDIR, 0755); err != nil {
+func (repo *Repository) Init() error {
+	if err := os.MkdirAll(repo.GitDir, 0755); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(fmt.Sprintf("%s/objects", GITDIR), 0755); err != nil {
+	if err := os.MkdirAll(repo.Path("objects"), 0755); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(fmt.Sprintf("%s/refs/tags", GITDIR), 0755); err != nil {
+	if err := os.MkdirAll(repo.Path("refs", "tags"), 0755); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(fmt.Sprintf("%s/refs/heads", GITDIR), 0755); err != nil {
+	if err := os.MkdirAll(repo.Path("refs", "heads"), 0755); err != nil {
 		return err
 	}
 	return nil
 }
 
-// HashObject gen hash from data and save data.
-func HashObject(data []byte, dtype Type) ([]byte, error) {
-	data = append([]byte{byte(dtype)}, data...)
+// Hash gen hash from data without saving it
+func Hash(data []byte, dtype Type) []byte {
 	h := sha1.New()
-	if _, err := h.Write(data); err != nil {
-		return []byte{}, err
+	h.Write([]byte{byte(dtype)})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// HashObject gen hash from data and save data.
+// An existing loose object is freshened instead, so prune does not take it
+// as long unreferenced.
+func (repo *Repository) HashObject(data []byte, dtype Type) ([]byte, error) {
+	bs := Hash(data, dtype)
+	if repo.freshenLooseObject(bs) {
+		return bs, nil
+	}
+	if _, _, ok := repo.findPacked(bs); ok {
+		return bs, nil
 	}
-	bs := h.Sum(nil)
-	p := fmt.Sprintf("%s/objects/%x", GITDIR, bs)
-	if err := ioutil.WriteFile(p, data, 0755); err != nil {
+	if err := repo.writeLooseObject(bs, dtype, data); err != nil {
 		return []byte{}, err
 	}
 	return bs, nil
 }
 
 // GetObject get file from hash
-func GetObject(oid []byte, expected Type) ([]byte, error) {
-	path := fmt.Sprintf("%s/objects/%x", GITDIR, oid)
-	b, err := ioutil.ReadFile(path)
+func (repo *Repository) GetObject(oid []byte, expected Type) ([]byte, error) {
+	r, err := repo.openLooseObject(oid)
+	if os.IsNotExist(err) {
+		t, b, perr := repo.readPacked(oid)
+		if perr == nil {
+			if expected != None && expected != t {
+				return []byte{}, fmt.Errorf("data type is invalid")
+			}
+			return b, nil
+		}
+		if !os.IsNotExist(perr) {
+			err = perr
+		}
+	}
 	if err != nil {
 		return []byte{}, err
 	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return []byte{}, fmt.Errorf("object %x is corrupt: %v", oid, err)
+	}
+	if len(b) == 0 {
+		return []byte{}, fmt.Errorf("object %x is empty", oid)
+	}
 	if t := Type(b[0]); expected != None && expected != t {
 		return []byte{}, fmt.Errorf("data type is invalid")
 	}
@@ -86,33 +147,258 @@ func GetObject(oid []byte, expected Type) ([]byte, error) {
 }
 
 // GetType get data type
-func GetType(oid []byte) (Type, error) {
-	path := fmt.Sprintf("%s/objects/%x", GITDIR, oid)
-	b, err := ioutil.ReadFile(path)
+func (repo *Repository) GetType(oid []byte) (Type, error) {
+	r, err := repo.openLooseObject(oid)
+	if os.IsNotExist(err) {
+		if t, perr := repo.packedType(oid); perr == nil {
+			return t, nil
+		}
+	}
 	if err != nil {
 		return None, err
 	}
+	defer r.Close()
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return None, fmt.Errorf("object %x is corrupt: %v", oid, err)
+	}
 	return Type(b[0]), nil
 }
 
-// UpdateRef update ref
-func UpdateRef(name string, ref RefValue, deref bool) error {
-	if n, _, err := getRef(name, deref); err == nil {
-		name = n
+// VerifyObject check that every stored copy of object hashes to its oid
+func (repo *Repository) VerifyObject(oid []byte) error {
+	if repo.IsLoose(oid) {
+		r, err := repo.openLooseObject(oid)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("loose object %x is corrupt: %v", oid, err)
+		}
+		if len(b) == 0 {
+			return fmt.Errorf("loose object %x is empty", oid)
+		}
+		if h := Hash(b[1:], Type(b[0])); !bytes.Equal(h, oid) {
+			return fmt.Errorf("loose object %x hashes to %x", oid, h)
+		}
+	}
+	if _, _, ok := repo.findPacked(oid); ok {
+		t, b, err := repo.readPacked(oid)
+		if err != nil {
+			return err
+		}
+		if h := Hash(b, t); !bytes.Equal(h, oid) {
+			return fmt.Errorf("packed object %x hashes to %x", oid, h)
+		}
+	}
+	return nil
+}
+
+// HasObject report whether object is stored, loose or packed
+func (repo *Repository) HasObject(oid []byte) bool {
+	if repo.IsLoose(oid) {
+		return true
+	}
+	_, _, ok := repo.findPacked(oid)
+	return ok
+}
+
+// FindObjects get stored objects whose hex oid starts with prefix
+func (repo *Repository) FindObjects(prefix string) ([][]byte, error) {
+	prefix = strings.ToLower(prefix)
+	loose, err := repo.ListLooseObjects()
+	if err != nil {
+		return nil, err
+	}
+	packed, err := repo.ListPackedObjects()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	oids := [][]byte{}
+	for _, oid := range append(loose, packed...) {
+		h := hex.EncodeToString(oid)
+		if !strings.HasPrefix(h, prefix) || seen[h] {
+			continue
+		}
+		seen[h] = true
+		oids = append(oids, oid)
+	}
+	sort.Slice(oids, func(i, j int) bool { return bytes.Compare(oids[i], oids[j]) < 0 })
+	return oids, nil
+}
+
+// UpdateRef update ref, and record the update with reason msg in reflog
+// of the written ref and of the symbolic ref it was reached through
+func (repo *Repository) UpdateRef(name string, ref RefValue, deref bool, msg string) error {
+	return repo.CompareAndSwapRef(name, nil, ref, deref, msg)
+}
+
+// RefMismatchError is returned when a ref does not hold the expected old value
+type RefMismatchError struct {
+	Name     string
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *RefMismatchError) Error() string {
+	switch {
+	case e.Actual == nil:
+		return fmt.Sprintf("cannot lock ref '%s': unable to resolve reference, expected %x", e.Name, e.Expected)
+	case IsZeroOid(e.Expected):
+		return fmt.Sprintf("cannot lock ref '%s': reference already exists", e.Name)
+	}
+	return fmt.Sprintf("cannot lock ref '%s': is at %x but expected %x", e.Name, e.Actual, e.Expected)
+}
+
+// checkOld lock ref file of name, and check that name resolves to old.
+// A nil old skips the check, and the zero oid requires name not to exist.
+func (repo *Repository) checkOld(name, target string, old []byte) (*lockFile, []byte, error) {
+	path := repo.Path(target)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, nil, err
+	}
+	l, err := lock(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cur []byte
+	if r, err := repo.GetRef(name, true); err == nil {
+		cur = r.Value
+	}
+	if old != nil && !(IsZeroOid(old) && cur == nil) && !bytes.Equal(old, cur) {
+		l.rollback()
+		return nil, nil, &RefMismatchError{Name: name, Expected: old, Actual: cur}
+	}
+	return l, cur, nil
+}
+
+// CompareAndSwapRef update ref like UpdateRef, only if name currently resolves to old.
+// A nil old skips the check, and the zero oid requires name not to exist.
+func (repo *Repository) CompareAndSwapRef(name string, old []byte, ref RefValue, deref bool, msg string) error {
+	target, err := repo.resolveRefName(name, deref)
+	if err != nil {
+		return err
+	}
+	if err := CheckRefName(target); err != nil {
+		return err
 	}
 	if ref.Symblic {
-		ref.Value = []byte(fmt.Sprintf("ref:%s", string(ref.Value)))
+		if err := CheckRefName(string(ref.Value)); err != nil {
+			return err
+		}
+	}
+	if err := repo.checkRefConflict(target); err != nil {
+		return err
 	}
-	path := fmt.Sprintf("%s/%s", GITDIR, name)
-	if err := ioutil.WriteFile(path, ref.Value, 0644); err != nil {
+	l, cur, err := repo.checkOld(name, target, old)
+	if err != nil {
 		return err
 	}
+	value := ref.Value
+	if ref.Symblic {
+		value = []byte(fmt.Sprintf("ref:%s", string(ref.Value)))
+	}
+	if err := l.commit(value); err != nil {
+		return err
+	}
+	new := ref.Value
+	if ref.Symblic {
+		new = nil
+		if r, err := repo.GetRef(target, true); err == nil {
+			new = r.Value
+		}
+	}
+	if new == nil {
+		return nil
+	}
+	for _, n := range []string{target, name} {
+		if !hasReflog(n) {
+			continue
+		}
+		if err := repo.AppendReflog(n, cur, new, msg); err != nil {
+			return err
+		}
+		if n == name {
+			break
+		}
+	}
 	return nil
 }
 
-func getRef(name string, deref bool) (string, RefValue, error) {
-	path := fmt.Sprintf("%s/%s", GITDIR, name)
+// DeleteRef delete ref and its reflog
+func (repo *Repository) DeleteRef(name string, deref bool) error {
+	return repo.CompareAndDeleteRef(name, nil, deref)
+}
+
+// CompareAndDeleteRef delete ref like DeleteRef, only if name currently resolves to old.
+// A nil old skips the check.
+func (repo *Repository) CompareAndDeleteRef(name string, old []byte, deref bool) error {
+	target, err := repo.resolveRefName(name, deref)
+	if err != nil {
+		return err
+	}
+	l, _, err := repo.checkOld(name, target, old)
+	if err != nil {
+		return err
+	}
+	defer l.rollback()
+	err = os.Remove(repo.Path(target))
+	if os.IsNotExist(err) && repo.HasRef(target) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(target, "refs/") {
+		if err := repo.removePackedRef(target); err != nil {
+			return err
+		}
+	}
+	l.rollback()
+	removeEmptyRefDirs(repo.GitDir, target)
+	return repo.DeleteReflog(target)
+}
+
+// resolveRefName follow symbolic refs from name when deref, even to a ref not created yet
+func (repo *Repository) resolveRefName(name string, deref bool) (string, error) {
+	for depth := 0; deref; depth++ {
+		if depth > maxSymrefDepth {
+			return "", fmt.Errorf("symbolic ref %s is too deep or cyclic", name)
+		}
+		_, r, err := repo.getRefDepth(name, false, 0)
+		if err != nil || !r.Symblic {
+			break
+		}
+		name = string(r.Value)
+	}
+	return name, nil
+}
+
+// maxSymrefDepth bound symbolic ref chains, so cycles fail instead of looping
+const maxSymrefDepth = 5
+
+func (repo *Repository) getRef(name string, deref bool) (string, RefValue, error) {
+	return repo.getRefDepth(name, deref, 0)
+}
+
+func (repo *Repository) getRefDepth(name string, deref bool, depth int) (string, RefValue, error) {
+	if depth > maxSymrefDepth {
+		return "", RefValue{}, fmt.Errorf("symbolic ref %s is too deep or cyclic", name)
+	}
+	path := repo.Path(name)
 	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && strings.HasPrefix(name, "refs/") {
+		p, perr := repo.readPackedRefs()
+		if perr != nil {
+			return "", RefValue{}, perr
+		}
+		if oid, ok := p.refs[name]; ok {
+			return name, RefValue{Symblic: false, Value: oid}, nil
+		}
+	}
 	if err != nil {
 		return "", RefValue{}, err
 	}
@@ -123,7 +409,7 @@ func getRef(name string, deref bool) (string, RefValue, error) {
 			return "", RefValue{}, fmt.Errorf("invalid format")
 		}
 		if deref {
-			return getRef(fmt.Sprintf("%s", s[1]), deref)
+			return repo.getRefDepth(fmt.Sprintf("%s", s[1]), deref, depth+1)
 		}
 		return name, RefValue{Symblic: true, Value: s[1]}, nil
 	}
@@ -131,20 +417,78 @@ func getRef(name string, deref bool) (string, RefValue, error) {
 }
 
 // GetRef get ref
-func GetRef(name string, deref bool) (RefValue, error) {
-	_, r, err := getRef(name, deref)
+func (repo *Repository) GetRef(name string, deref bool) (RefValue, error) {
+	_, r, err := repo.getRef(name, deref)
 	if err != nil {
 		return RefValue{}, err
 	}
 	return r, nil
 }
 
+// treeMagic marks trees written in the length-prefixed format.
+// Trees without it are legacy `oid 00 00 name 00 00` trees.
+var treeMagic = []byte("tree v2\x00")
+
+// IsLegacyTree report whether tree is stored in legacy format
+func (repo *Repository) IsLegacyTree(oid []byte) (bool, error) {
+	h, err := repo.GetObject(oid, Tree)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.HasPrefix(h, treeMagic), nil
+}
+
 // GetTreeEntries get entries
-func GetTreeEntries(oid []byte) ([]Entry, error) {
-	h, err := GetObject(oid, Tree)
+func (repo *Repository) GetTreeEntries(oid []byte) ([]Entry, error) {
+	h, err := repo.GetObject(oid, Tree)
 	if err != nil {
 		return nil, err
 	}
+	if !bytes.HasPrefix(h, treeMagic) {
+		ents := getLegacyTreeEntries(h)
+		for i := range ents {
+			ents[i].Name = entryName(ents[i].Name)
+			ents[i].Mode = repo.defaultMode(ents[i].Oid)
+		}
+		return ents, nil
+	}
+	h = h[len(treeMagic):]
+	ents := make([]Entry, 0)
+	for len(h) > 0 {
+		sp := bytes.IndexByte(h, ' ')
+		if sp < 0 {
+			return nil, fmt.Errorf("invalid tree %x: missing mode", oid)
+		}
+		mode, err := strconv.ParseUint(string(h[:sp]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree %x: bad mode %q", oid, h[:sp])
+		}
+		h = h[sp+1:]
+		nul := bytes.IndexByte(h, 0)
+		if nul < 0 {
+			return nil, fmt.Errorf("invalid tree %x: missing name", oid)
+		}
+		name := entryName(string(h[:nul]))
+		h = h[nul+1:]
+		if len(h) < sha1.Size {
+			return nil, fmt.Errorf("invalid tree %x: truncated oid", oid)
+		}
+		o := make([]byte, sha1.Size)
+		copy(o, h[:sha1.Size])
+		h = h[sha1.Size:]
+		ents = append(ents, Entry{Oid: o, Name: name, Mode: uint32(mode)})
+	}
+	return ents, nil
+}
+
+// entryName get basename of entry name, since trees written by
+// older versions hold full paths such as `src/a.go`
+func entryName(name string) string {
+	name = filepath.ToSlash(name)
+	return name[strings.LastIndexByte(name, '/')+1:]
+}
+
+func getLegacyTreeEntries(h []byte) []Entry {
 	ents := make([]Entry, 0)
 	o := make([]byte, 0)
 	for k, b := range bytes.Split(h, []byte{0, 0}) {
@@ -154,45 +498,68 @@ func GetTreeEntries(oid []byte) ([]Entry, error) {
 		}
 		ents = append(ents, Entry{Oid: o, Name: string(b)})
 	}
-	return ents, nil
+	return ents
 }
 
-// HashTreeEntries set entries
-func HashTreeEntries(ents []Entry) ([]byte, error) {
-	conts := make([]byte, 0)
-	for _, ent := range ents {
-		c := ent.Oid
-		c = append(c, []byte{0, 0}...)
-		c = append(c, []byte(ent.Name)...)
-		c = append(c, []byte{0, 0}...)
-		conts = append(conts, c...)
+// defaultMode get mode of entry without recorded mode, from object type
+func (repo *Repository) defaultMode(oid []byte) uint32 {
+	if t, err := repo.GetType(oid); err == nil && t == Tree {
+		return ModeTree
 	}
-	return HashObject(conts, Tree)
+	return ModeFile
 }
 
-// GetRefs get refs
-func GetRefs(prefix string, deref bool) ([]string, []RefValue, error) {
-	names := []string{"HEAD"}
-	err := filepath.Walk(fmt.Sprintf("%s/refs", GITDIR), func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// HashTreeEntries set entries. Entries without mode get one from object type.
+func (repo *Repository) HashTreeEntries(ents []Entry) ([]byte, error) {
+	ents = append([]Entry{}, ents...)
+	for i, ent := range ents {
+		if len(ent.Oid) != sha1.Size {
+			return nil, fmt.Errorf("invalid oid %x for %s", ent.Oid, ent.Name)
 		}
-		if !info.IsDir() {
-			kind := filepath.Base(filepath.Dir(path))
-			names = append(names, fmt.Sprintf("refs/%s/%s", kind, info.Name()))
+		if len(ent.Name) == 0 || ent.Name == "." || ent.Name == ".." || strings.ContainsAny(ent.Name, "/\x00") {
+			return nil, fmt.Errorf("invalid name %q", ent.Name)
 		}
-		return nil
+		if ent.Mode == 0 {
+			ents[i].Mode = repo.defaultMode(ent.Oid)
+		}
+	}
+	// canonical order is git's, where a tree sorts as if its name ended with `/`
+	sort.Slice(ents, func(i, j int) bool {
+		return sortName(ents[i]) < sortName(ents[j])
 	})
+	conts := append([]byte{}, treeMagic...)
+	for i, ent := range ents {
+		if i > 0 && ents[i-1].Name == ent.Name {
+			return nil, fmt.Errorf("duplicate name %q", ent.Name)
+		}
+		conts = append(conts, []byte(fmt.Sprintf("%o %s", ent.Mode, ent.Name))...)
+		conts = append(conts, 0)
+		conts = append(conts, ent.Oid...)
+	}
+	return repo.HashObject(conts, Tree)
+}
+
+func sortName(e Entry) string {
+	if e.Mode == ModeTree {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// GetRefs get refs
+func (repo *Repository) GetRefs(prefix string, deref bool) ([]string, []RefValue, error) {
+	names, err := repo.listRefNames()
 	if err != nil {
 		return nil, nil, err
 	}
+	names = append([]string{"HEAD"}, names...)
 	refnames := []string{}
 	refs := []RefValue{}
 	for _, name := range names {
 		if !strings.HasPrefix(name, prefix) {
 			continue
 		}
-		r, err := GetRef(name, deref)
+		r, err := repo.GetRef(name, deref)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -201,3 +568,15 @@ func GetRefs(prefix string, deref bool) ([]string, []RefValue, error) {
 	}
 	return refnames, refs, nil
 }
+
+// ListRefNames list names of existing refs, including HEAD
+func (repo *Repository) ListRefNames() ([]string, error) {
+	names, err := repo.listRefNames()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(repo.Path("HEAD")); err == nil {
+		names = append([]string{"HEAD"}, names...)
+	}
+	return names, nil
+}
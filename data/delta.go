@@ -0,0 +1,159 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// deltaBlock is the length of chunks indexed in the base when searching copies
+const deltaBlock = 16
+
+// MakeDelta encode target as copy and insert instructions against base,
+// in the same layout as Git's pack deltas
+func MakeDelta(base, target []byte) []byte {
+	out := bytes.Buffer{}
+	out.Write(uvarint(uint64(len(base))))
+	out.Write(uvarint(uint64(len(target))))
+
+	index := map[string]int{}
+	for i := 0; i+deltaBlock <= len(base); i += deltaBlock {
+		k := string(base[i : i+deltaBlock])
+		if _, ok := index[k]; !ok {
+			index[k] = i
+		}
+	}
+
+	insert := []byte{}
+	flush := func() {
+		for len(insert) > 0 {
+			n := len(insert)
+			if n > 0x7f {
+				n = 0x7f
+			}
+			out.WriteByte(byte(n))
+			out.Write(insert[:n])
+			insert = insert[n:]
+		}
+	}
+	for i := 0; i < len(target); {
+		off, ok := -1, false
+		if i+deltaBlock <= len(target) {
+			off, ok = index[string(target[i:i+deltaBlock])]
+		}
+		if !ok {
+			insert = append(insert, target[i])
+			i++
+			continue
+		}
+		n := deltaBlock
+		for off+n < len(base) && i+n < len(target) && base[off+n] == target[i+n] {
+			n++
+		}
+		// extend backwards into pending insert
+		for len(insert) > 0 && off > 0 && base[off-1] == insert[len(insert)-1] {
+			insert = insert[:len(insert)-1]
+			off--
+			i--
+			n++
+		}
+		flush()
+		writeCopy(&out, off, n)
+		i += n
+	}
+	flush()
+	return out.Bytes()
+}
+
+func writeCopy(out *bytes.Buffer, off, n int) {
+	for n > 0 {
+		size := n
+		if size > 0xffffff {
+			size = 0xffffff
+		}
+		cmd := byte(0x80)
+		args := []byte{}
+		for b := uint(0); b < 4; b++ {
+			if v := byte(off >> (8 * b)); v != 0 {
+				cmd |= 1 << b
+				args = append(args, v)
+			}
+		}
+		for b := uint(0); b < 3; b++ {
+			if v := byte(size >> (8 * b)); v != 0 {
+				cmd |= 0x10 << b
+				args = append(args, v)
+			}
+		}
+		out.WriteByte(cmd)
+		out.Write(args)
+		off += size
+		n -= size
+	}
+}
+
+// ApplyDelta rebuild target from base and delta made by MakeDelta
+func ApplyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	bsize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delta: %v", err)
+	}
+	if bsize != uint64(len(base)) {
+		return nil, fmt.Errorf("invalid delta: base size %d, want %d", len(base), bsize)
+	}
+	tsize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delta: %v", err)
+	}
+	out := make([]byte, 0, tsize)
+	for r.Len() > 0 {
+		cmd, _ := r.ReadByte()
+		if cmd&0x80 == 0 {
+			if cmd == 0 {
+				return nil, fmt.Errorf("invalid delta: zero insert")
+			}
+			lit := make([]byte, cmd)
+			if n, _ := r.Read(lit); n != int(cmd) {
+				return nil, fmt.Errorf("invalid delta: truncated insert")
+			}
+			out = append(out, lit...)
+			continue
+		}
+		off, size := 0, 0
+		for b := uint(0); b < 4; b++ {
+			if cmd&(1<<b) != 0 {
+				v, err := r.ReadByte()
+				if err != nil {
+					return nil, fmt.Errorf("invalid delta: truncated copy")
+				}
+				off |= int(v) << (8 * b)
+			}
+		}
+		for b := uint(0); b < 3; b++ {
+			if cmd&(0x10<<b) != 0 {
+				v, err := r.ReadByte()
+				if err != nil {
+					return nil, fmt.Errorf("invalid delta: truncated copy")
+				}
+				size |= int(v) << (8 * b)
+			}
+		}
+		if size == 0 {
+			size = 0x10000
+		}
+		if off+size > len(base) {
+			return nil, fmt.Errorf("invalid delta: copy out of range")
+		}
+		out = append(out, base[off:off+size]...)
+	}
+	if uint64(len(out)) != tsize {
+		return nil, fmt.Errorf("invalid delta: result size %d, want %d", len(out), tsize)
+	}
+	return out, nil
+}
+
+func uvarint(v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, v)]
+}
@@ -0,0 +1,147 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Role is identity role
+type Role string
+
+const (
+	// Author who wrote the change
+	Author Role = "AUTHOR"
+	// Committer who recorded the change
+	Committer Role = "COMMITTER"
+)
+
+// Signature is identity with timestamp
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+var dateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.UnixDate,
+	time.ANSIC,
+	"Mon Jan 2 15:04:05 2006 -0700",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// String format signature as `name <email> unix +zone`
+func (s Signature) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.When.Unix(), s.When.Format("-0700"))
+}
+
+// Ident format signature without timestamp
+func (s Signature) Ident() string {
+	return fmt.Sprintf("%s <%s>", s.Name, s.Email)
+}
+
+// ParseSignature parse `name <email> unix +zone`
+func ParseSignature(s string) (Signature, error) {
+	sig, rest, err := parseIdent(s)
+	if err != nil {
+		return Signature{}, err
+	}
+	if sig.When, err = ParseDate(rest); err != nil {
+		return Signature{}, err
+	}
+	return sig, nil
+}
+
+// ParseIdent parse `name <email>`
+func ParseIdent(s string) (Signature, error) {
+	sig, rest, err := parseIdent(s)
+	if err != nil {
+		return Signature{}, err
+	}
+	if len(rest) > 0 {
+		return Signature{}, fmt.Errorf("invalid identity %q", s)
+	}
+	return sig, nil
+}
+
+func parseIdent(s string) (Signature, string, error) {
+	lt := strings.IndexByte(s, '<')
+	gt := strings.IndexByte(s, '>')
+	if lt < 0 || gt < lt {
+		return Signature{}, "", fmt.Errorf("invalid identity %q", s)
+	}
+	sig := Signature{
+		Name:  strings.TrimSpace(s[:lt]),
+		Email: s[lt+1 : gt],
+	}
+	return sig, strings.TrimSpace(s[gt+1:]), nil
+}
+
+// ParseDate parse `unix +zone`, `@unix` or a human readable date
+func ParseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	f := strings.Fields(strings.TrimPrefix(s, "@"))
+	if len(f) > 0 && len(f) <= 2 {
+		if sec, err := strconv.ParseInt(f[0], 10, 64); err == nil {
+			t := time.Unix(sec, 0).UTC()
+			if len(f) == 1 {
+				return t.Local(), nil
+			}
+			z, err := time.Parse("-0700", f[1])
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid timezone %q", f[1])
+			}
+			return t.In(z.Location()), nil
+		}
+	}
+	for _, l := range dateLayouts {
+		if t, err := time.ParseInLocation(l, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", s)
+}
+
+// GetIdent get identity from environment or config
+func (repo *Repository) GetIdent(role Role) (Signature, error) {
+	sig := Signature{
+		Name:  os.Getenv(fmt.Sprintf("UGIT_%s_NAME", role)),
+		Email: os.Getenv(fmt.Sprintf("UGIT_%s_EMAIL", role)),
+		When:  time.Now(),
+	}
+	if len(sig.Name) == 0 {
+		sig.Name, _ = repo.GetConfig("user.name")
+	}
+	if len(sig.Email) == 0 {
+		sig.Email, _ = repo.GetConfig("user.email")
+	}
+	if len(sig.Name) == 0 {
+		sig.Name = os.Getenv("USER")
+	}
+	if len(sig.Name) == 0 {
+		sig.Name = "ugit"
+	}
+	if len(sig.Email) == 0 {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+		sig.Email = fmt.Sprintf("%s@%s", sig.Name, host)
+	}
+	if d := os.Getenv(fmt.Sprintf("UGIT_%s_DATE", role)); len(d) > 0 {
+		t, err := ParseDate(d)
+		if err != nil {
+			return Signature{}, err
+		}
+		sig.When = t
+	}
+	return sig, nil
+}
@@ -0,0 +1,178 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// File modes recorded in the index and trees
+const (
+	ModeFile       uint32 = 0100644
+	ModeExecutable uint32 = 0100755
+	ModeSymlink    uint32 = 0120000
+	ModeTree       uint32 = 040000
+)
+
+var indexMagic = []byte("UIDX")
+
+const indexVersion uint32 = 2
+
+const indexConflict uint16 = 1
+
+// IndexEntry is staged file
+type IndexEntry struct {
+	Path       string
+	Mode       uint32
+	Oid        []byte
+	Size       int64
+	Mtime      int64
+	Ctime      int64
+	Ino        uint64
+	Conflicted bool
+}
+
+type indexHeaderV1 struct {
+	Mode  uint32
+	Size  int64
+	Mtime int64
+	Ctime int64
+	Ino   uint64
+	Oid   [sha1.Size]byte
+	Len   uint16
+}
+
+type indexHeader struct {
+	indexHeaderV1
+	Flags uint16
+}
+
+// NewIndexEntry create index entry from file info
+func NewIndexEntry(path string, oid []byte, fi os.FileInfo) IndexEntry {
+	e := IndexEntry{
+		Path:  path,
+		Mode:  FileMode(fi),
+		Oid:   oid,
+		Size:  fi.Size(),
+		Mtime: fi.ModTime().UnixNano(),
+	}
+	e.Ctime, e.Ino = statExtra(fi)
+	return e
+}
+
+// FileMode get index mode from file info
+func FileMode(fi os.FileInfo) uint32 {
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		return ModeSymlink
+	case fi.Mode()&0111 != 0:
+		return ModeExecutable
+	}
+	return ModeFile
+}
+
+// ReadIndex read index
+func (repo *Repository) ReadIndex() ([]IndexEntry, error) {
+	return readEntries(repo.Path("index"), indexMagic)
+}
+
+// WriteIndex write index, sorted by path
+func (repo *Repository) WriteIndex(ents []IndexEntry) error {
+	return writeEntries(repo.Path("index"), indexMagic, ents)
+}
+
+// readEntries read file of index entries
+func readEntries(path string, magic []byte) ([]IndexEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []IndexEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < len(magic)+8+sha1.Size || !bytes.HasPrefix(b, magic) {
+		return nil, fmt.Errorf("%s is corrupt", path)
+	}
+	body, sum := b[:len(b)-sha1.Size], b[len(b)-sha1.Size:]
+	if s := sha1.Sum(body); !bytes.Equal(s[:], sum) {
+		return nil, fmt.Errorf("%s checksum mismatch", path)
+	}
+	r := bytes.NewReader(body[len(magic):])
+	var ver, n uint32
+	if err := binary.Read(r, binary.BigEndian, &ver); err != nil {
+		return nil, err
+	}
+	if ver != 1 && ver != indexVersion {
+		return nil, fmt.Errorf("unsupported %s version %d", path, ver)
+	}
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	ents := make([]IndexEntry, 0, n)
+	for i := uint32(0); i < n; i++ {
+		h := indexHeader{}
+		if ver == 1 {
+			err = binary.Read(r, binary.BigEndian, &h.indexHeaderV1)
+		} else {
+			err = binary.Read(r, binary.BigEndian, &h)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s is corrupt: %v", path, err)
+		}
+		p := make([]byte, h.Len)
+		if _, err := r.Read(p); err != nil {
+			return nil, fmt.Errorf("%s is corrupt: %v", path, err)
+		}
+		ents = append(ents, IndexEntry{
+			Path:       string(p),
+			Mode:       h.Mode,
+			Oid:        append([]byte{}, h.Oid[:]...),
+			Size:       h.Size,
+			Mtime:      h.Mtime,
+			Ctime:      h.Ctime,
+			Ino:        h.Ino,
+			Conflicted: h.Flags&indexConflict != 0,
+		})
+	}
+	return ents, nil
+}
+
+// writeEntries write file of index entries, sorted by path
+func writeEntries(path string, magic []byte, ents []IndexEntry) error {
+	sort.Slice(ents, func(i, j int) bool {
+		return ents[i].Path < ents[j].Path
+	})
+	buf := bytes.NewBuffer(append([]byte{}, magic...))
+	binary.Write(buf, binary.BigEndian, indexVersion)
+	binary.Write(buf, binary.BigEndian, uint32(len(ents)))
+	for _, e := range ents {
+		if len(e.Path) > 0xffff {
+			return fmt.Errorf("path too long: %s", e.Path)
+		}
+		h := indexHeader{}
+		h.Mode = e.Mode
+		h.Size = e.Size
+		h.Mtime = e.Mtime
+		h.Ctime = e.Ctime
+		h.Ino = e.Ino
+		h.Len = uint16(len(e.Path))
+		copy(h.Oid[:], e.Oid)
+		if e.Conflicted {
+			h.Flags |= indexConflict
+		}
+		binary.Write(buf, binary.BigEndian, h)
+		buf.WriteString(e.Path)
+	}
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+
+	l, err := lock(path)
+	if err != nil {
+		return err
+	}
+	return l.commit(buf.Bytes())
+}
@@ -0,0 +1,78 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockTimeout is how long to wait for a lock held by another process
+const lockTimeout = time.Second
+
+// LockError is returned when a file stays locked by another process
+type LockError struct {
+	Path string
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("Unable to create '%s': File exists.\n\n"+
+		"Another ugit process seems to be running in this repository.\n"+
+		"If it still fails, a ugit process may have crashed in this repository earlier:\n"+
+		"remove the file manually to continue.", e.Path)
+}
+
+// lockFile is an exclusive `<path>.lock` file. New contents are written to it,
+// and renamed over path on commit, so readers never see a partial write.
+type lockFile struct {
+	path string
+	f    *os.File
+	done bool
+}
+
+// lock create lock file of path, waiting up to lockTimeout for other processes
+func lock(path string) (*lockFile, error) {
+	lp := path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return &lockFile{path: path, f: f}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, &LockError{Path: lp}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// commit replace path with b, and release lock
+func (l *lockFile) commit(b []byte) error {
+	defer l.rollback()
+	if _, err := l.f.Write(b); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.f.Name(), l.path); err != nil {
+		return err
+	}
+	l.done = true
+	return nil
+}
+
+// rollback release lock leaving path untouched, unless already committed
+func (l *lockFile) rollback() {
+	if l.done {
+		return
+	}
+	l.done = true
+	l.f.Close()
+	os.Remove(l.f.Name())
+}
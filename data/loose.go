@@ -0,0 +1,148 @@
+package data
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// looseObjectPath is objects/<2 hex>/<38 hex>, with zlib compressed content
+func (repo *Repository) looseObjectPath(oid []byte) string {
+	h := fmt.Sprintf("%x", oid)
+	if len(h) < 3 {
+		return repo.Path("objects", h)
+	}
+	return repo.Path("objects", h[:2], h[2:])
+}
+
+// legacyObjectPath is objects/<40 hex>, with uncompressed content
+func (repo *Repository) legacyObjectPath(oid []byte) string {
+	return repo.Path("objects", fmt.Sprintf("%x", oid))
+}
+
+type zlibFile struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (z *zlibFile) Close() error {
+	z.ReadCloser.Close()
+	return z.f.Close()
+}
+
+// openLooseObject open type byte and content of object, from either layout
+func (repo *Repository) openLooseObject(oid []byte) (io.ReadCloser, error) {
+	f, err := os.Open(repo.looseObjectPath(oid))
+	if os.IsNotExist(err) {
+		return os.Open(repo.legacyObjectPath(oid))
+	}
+	if err != nil {
+		return nil, err
+	}
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("object %x is corrupt: %v", oid, err)
+	}
+	return &zlibFile{ReadCloser: z, f: f}, nil
+}
+
+// writeLooseObject write compressed object via temp file and rename,
+// so readers never see a partially written object
+func (repo *Repository) writeLooseObject(oid []byte, dtype Type, data []byte) error {
+	buf := bytes.Buffer{}
+	z := zlib.NewWriter(&buf)
+	z.Write([]byte{byte(dtype)})
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		return err
+	}
+	p := repo.looseObjectPath(oid)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, buf.Bytes(), 0444)
+}
+
+// ListLooseObjects list oids stored as loose objects, in both layouts
+func (repo *Repository) ListLooseObjects() ([][]byte, error) {
+	dir := repo.Path("objects")
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	oids := [][]byte{}
+	for _, f := range fs {
+		if !f.IsDir() {
+			if oid, err := hex.DecodeString(f.Name()); err == nil && len(oid) == sha1.Size {
+				oids = append(oids, oid)
+			}
+			continue
+		}
+		if len(f.Name()) != 2 {
+			continue
+		}
+		sub, err := ioutil.ReadDir(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range sub {
+			if oid, err := hex.DecodeString(f.Name() + o.Name()); err == nil && len(oid) == sha1.Size {
+				oids = append(oids, oid)
+			}
+		}
+	}
+	return oids, nil
+}
+
+// IsLoose report whether object is stored as loose object
+func (repo *Repository) IsLoose(oid []byte) bool {
+	if _, err := os.Stat(repo.looseObjectPath(oid)); err == nil {
+		return true
+	}
+	_, err := os.Stat(repo.legacyObjectPath(oid))
+	return err == nil
+}
+
+// RemoveLooseObject delete loose copies of object
+func (repo *Repository) RemoveLooseObject(oid []byte) error {
+	for _, p := range []string{repo.looseObjectPath(oid), repo.legacyObjectPath(oid)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	os.Remove(filepath.Dir(repo.looseObjectPath(oid)))
+	return nil
+}
+
+// freshenLooseObject set modification time of loose object to now, so prune
+// keeps it for the grace period as if just written. It reports whether a
+// loose copy was freshened.
+func (repo *Repository) freshenLooseObject(oid []byte) bool {
+	now := time.Now()
+	for _, p := range []string{repo.looseObjectPath(oid), repo.legacyObjectPath(oid)} {
+		if err := os.Chtimes(p, now, now); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// LooseObjectTime get modification time of loose object
+func (repo *Repository) LooseObjectTime(oid []byte) (time.Time, error) {
+	fi, err := os.Stat(repo.looseObjectPath(oid))
+	if os.IsNotExist(err) {
+		fi, err = os.Stat(repo.legacyObjectPath(oid))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
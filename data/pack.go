@@ -0,0 +1,341 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	packMagic    = []byte("PACK")
+	packIdxMagic = []byte("PIDX")
+)
+
+const packVersion uint32 = 1
+
+const (
+	packFull  byte = 0
+	packDelta byte = 1
+)
+
+const (
+	// deltaWindow is how many preceding objects are tried as delta base
+	deltaWindow = 10
+	// maxDeltaDepth bound the length of delta chains
+	maxDeltaDepth = 50
+)
+
+// packIndex is loaded .idx of a pack
+type packIndex struct {
+	path    string
+	oids    [][]byte
+	offsets []uint64
+}
+
+func (repo *Repository) packDir() string {
+	return repo.Path("objects", "pack")
+}
+
+// loadPacks read every pack index once
+func (repo *Repository) loadPacks() ([]*packIndex, error) {
+	if repo.packs != nil {
+		return repo.packs, nil
+	}
+	names, err := filepath.Glob(filepath.Join(repo.packDir(), "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	ps := []*packIndex{}
+	for _, n := range names {
+		p, err := readPackIndex(n)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	repo.packs = ps
+	return repo.packs, nil
+}
+
+func readPackIndex(path string) (*packIndex, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < len(packIdxMagic)+8 || !bytes.HasPrefix(b, packIdxMagic) {
+		return nil, fmt.Errorf("%s is corrupt", path)
+	}
+	r := bytes.NewReader(b[len(packIdxMagic):])
+	var ver, n uint32
+	binary.Read(r, binary.BigEndian, &ver)
+	if ver != packVersion {
+		return nil, fmt.Errorf("unsupported %s version %d", path, ver)
+	}
+	binary.Read(r, binary.BigEndian, &n)
+	p := &packIndex{path: strings.TrimSuffix(path, ".idx") + ".pack"}
+	for i := uint32(0); i < n; i++ {
+		oid := make([]byte, sha1.Size)
+		var off uint64
+		if _, err := io.ReadFull(r, oid); err != nil {
+			return nil, fmt.Errorf("%s is corrupt: %v", path, err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &off); err != nil {
+			return nil, fmt.Errorf("%s is corrupt: %v", path, err)
+		}
+		p.oids = append(p.oids, oid)
+		p.offsets = append(p.offsets, off)
+	}
+	return p, nil
+}
+
+func (p *packIndex) find(oid []byte) (uint64, bool) {
+	i := sort.Search(len(p.oids), func(i int) bool {
+		return bytes.Compare(p.oids[i], oid) >= 0
+	})
+	if i < len(p.oids) && bytes.Equal(p.oids[i], oid) {
+		return p.offsets[i], true
+	}
+	return 0, false
+}
+
+// findPacked get pack and offset containing object
+func (repo *Repository) findPacked(oid []byte) (*packIndex, uint64, bool) {
+	ps, err := repo.loadPacks()
+	if err != nil {
+		return nil, 0, false
+	}
+	for _, p := range ps {
+		if off, ok := p.find(oid); ok {
+			return p, off, true
+		}
+	}
+	return nil, 0, false
+}
+
+// packEntry is header of an object in pack
+type packEntry struct {
+	kind  byte
+	dtype Type
+	base  []byte
+	size  uint64
+}
+
+func readPackEntry(r *bufio.Reader) (packEntry, []byte, error) {
+	e := packEntry{}
+	kind, err := r.ReadByte()
+	if err != nil {
+		return e, nil, err
+	}
+	t, err := r.ReadByte()
+	if err != nil {
+		return e, nil, err
+	}
+	e.kind, e.dtype = kind, Type(t)
+	if e.kind == packDelta {
+		e.base = make([]byte, sha1.Size)
+		if _, err := io.ReadFull(r, e.base); err != nil {
+			return e, nil, err
+		}
+	}
+	if e.size, err = binary.ReadUvarint(r); err != nil {
+		return e, nil, err
+	}
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return e, nil, err
+	}
+	defer z.Close()
+	payload := make([]byte, e.size)
+	if _, err := io.ReadFull(z, payload); err != nil {
+		return e, nil, err
+	}
+	return e, payload, nil
+}
+
+// readPacked get type and content of packed object, resolving delta chains
+func (repo *Repository) readPacked(oid []byte) (Type, []byte, error) {
+	p, off, ok := repo.findPacked(oid)
+	if !ok {
+		return None, nil, os.ErrNotExist
+	}
+	e, payload, err := readPackAt(p, off)
+	if err != nil {
+		return None, nil, fmt.Errorf("object %x in %s is corrupt: %v", oid, p.path, err)
+	}
+	if e.kind != packDelta {
+		return e.dtype, payload, nil
+	}
+	base, err := repo.GetObject(e.base, e.dtype)
+	if err != nil {
+		return None, nil, fmt.Errorf("delta base %x of %x: %v", e.base, oid, err)
+	}
+	b, err := ApplyDelta(base, payload)
+	if err != nil {
+		return None, nil, fmt.Errorf("object %x: %v", oid, err)
+	}
+	return e.dtype, b, nil
+}
+
+// packedType get type of packed object without resolving deltas
+func (repo *Repository) packedType(oid []byte) (Type, error) {
+	p, off, ok := repo.findPacked(oid)
+	if !ok {
+		return None, os.ErrNotExist
+	}
+	f, err := os.Open(p.path)
+	if err != nil {
+		return None, err
+	}
+	defer f.Close()
+	b := make([]byte, 2)
+	if _, err := f.ReadAt(b, int64(off)); err != nil {
+		return None, err
+	}
+	return Type(b[1]), nil
+}
+
+func readPackAt(p *packIndex, off uint64) (packEntry, []byte, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return packEntry{}, nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(int64(off), io.SeekStart); err != nil {
+		return packEntry{}, nil, err
+	}
+	return readPackEntry(bufio.NewReader(f))
+}
+
+// ListPackedObjects list oids in every pack
+func (repo *Repository) ListPackedObjects() ([][]byte, error) {
+	ps, err := repo.loadPacks()
+	if err != nil {
+		return nil, err
+	}
+	oids := [][]byte{}
+	for _, p := range ps {
+		oids = append(oids, p.oids...)
+	}
+	return oids, nil
+}
+
+type packObject struct {
+	oid   []byte
+	dtype Type
+	data  []byte
+	depth int
+}
+
+// WritePack store objects in a new pack with delta compression, and return its name
+func (repo *Repository) WritePack(oids [][]byte) (string, error) {
+	objs := make([]*packObject, 0, len(oids))
+	for _, oid := range oids {
+		t, err := repo.GetType(oid)
+		if err != nil {
+			return "", err
+		}
+		b, err := repo.GetObject(oid, t)
+		if err != nil {
+			return "", err
+		}
+		objs = append(objs, &packObject{oid: oid, dtype: t, data: b})
+	}
+	// similar objects end up next to each other, larger ones first as bases
+	sort.SliceStable(objs, func(i, j int) bool {
+		if objs[i].dtype != objs[j].dtype {
+			return objs[i].dtype < objs[j].dtype
+		}
+		return len(objs[i].data) > len(objs[j].data)
+	})
+
+	buf := bytes.NewBuffer(append([]byte{}, packMagic...))
+	binary.Write(buf, binary.BigEndian, packVersion)
+	binary.Write(buf, binary.BigEndian, uint32(len(objs)))
+	offsets := map[string]uint64{}
+	for i, o := range objs {
+		offsets[string(o.oid)] = uint64(buf.Len())
+		var base *packObject
+		payload := o.data
+		for j := i - 1; j >= 0 && j >= i-deltaWindow; j-- {
+			b := objs[j]
+			if b.dtype != o.dtype || b.depth >= maxDeltaDepth {
+				continue
+			}
+			d := MakeDelta(b.data, o.data)
+			if len(d) < len(payload) && len(d) < len(o.data)/2 {
+				base, payload = b, d
+			}
+		}
+		if base != nil {
+			o.depth = base.depth + 1
+			buf.Write([]byte{packDelta, byte(o.dtype)})
+			buf.Write(base.oid)
+		} else {
+			buf.Write([]byte{packFull, byte(o.dtype)})
+		}
+		buf.Write(uvarint(uint64(len(payload))))
+		z := zlib.NewWriter(buf)
+		z.Write(payload)
+		if err := z.Close(); err != nil {
+			return "", err
+		}
+	}
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+
+	sorted := append([][]byte{}, oids...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	idx := bytes.NewBuffer(append([]byte{}, packIdxMagic...))
+	binary.Write(idx, binary.BigEndian, packVersion)
+	binary.Write(idx, binary.BigEndian, uint32(len(sorted)))
+	for _, oid := range sorted {
+		idx.Write(oid)
+		binary.Write(idx, binary.BigEndian, offsets[string(oid)])
+	}
+	idx.Write(sum[:])
+
+	if err := os.MkdirAll(repo.packDir(), 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("pack-%x", sum)
+	base := filepath.Join(repo.packDir(), name)
+	// pack goes first, so an index never points at a missing pack
+	if err := writeFileAtomic(base+".pack", buf.Bytes(), 0444); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(base+".idx", idx.Bytes(), 0444); err != nil {
+		return "", err
+	}
+	repo.packs = nil
+	return name, nil
+}
+
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,160 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReflogEntry is a recorded ref update
+type ReflogEntry struct {
+	Old     []byte
+	New     []byte
+	Who     Signature
+	Message string
+}
+
+// String format entry as `old new name <email> unix +zone<TAB>message`
+func (e ReflogEntry) String() string {
+	return fmt.Sprintf("%x %x %s\t%s", e.Old, e.New, e.Who, e.Message)
+}
+
+// hasReflog report whether updates of ref are logged: HEAD and everything under refs/
+func hasReflog(name string) bool {
+	return name == "HEAD" || strings.HasPrefix(name, "refs/")
+}
+
+func (repo *Repository) reflogPath(name string) string {
+	return repo.Path("logs", filepath.FromSlash(name))
+}
+
+// AppendReflog record update of ref from old to new oid, nil meaning none
+func (repo *Repository) AppendReflog(name string, old, new []byte, msg string) error {
+	who, err := repo.GetIdent(Committer)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		old = make([]byte, sha1.Size)
+	}
+	if new == nil {
+		new = make([]byte, sha1.Size)
+	}
+	// a message is a single line
+	msg = strings.Join(strings.Fields(msg), " ")
+	e := ReflogEntry{Old: old, New: new, Who: who, Message: msg}
+	p := repo.reflogPath(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(e.String() + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadReflog get recorded updates of ref, oldest first
+func (repo *Repository) ReadReflog(name string) ([]ReflogEntry, error) {
+	b, err := ioutil.ReadFile(repo.reflogPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ents := []ReflogEntry{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		e, err := parseReflogLine(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("reflog of %s line %d: %v", name, n, err)
+		}
+		ents = append(ents, e)
+	}
+	return ents, sc.Err()
+}
+
+func parseReflogLine(line string) (ReflogEntry, error) {
+	head, msg := line, ""
+	if i := strings.IndexByte(line, '\t'); i >= 0 {
+		head, msg = line[:i], line[i+1:]
+	}
+	f := strings.SplitN(head, " ", 3)
+	if len(f) != 3 {
+		return ReflogEntry{}, fmt.Errorf("invalid entry %q", line)
+	}
+	old, err := hex.DecodeString(f[0])
+	if err != nil || len(old) != sha1.Size {
+		return ReflogEntry{}, fmt.Errorf("invalid old oid %q", f[0])
+	}
+	new, err := hex.DecodeString(f[1])
+	if err != nil || len(new) != sha1.Size {
+		return ReflogEntry{}, fmt.Errorf("invalid new oid %q", f[1])
+	}
+	who, err := ParseSignature(f[2])
+	if err != nil {
+		return ReflogEntry{}, err
+	}
+	return ReflogEntry{Old: old, New: new, Who: who, Message: msg}, nil
+}
+
+// ListReflogs get names of refs which have a reflog
+func (repo *Repository) ListReflogs() ([]string, error) {
+	root := repo.Path("logs")
+	names := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// DeleteReflog remove reflog of ref
+func (repo *Repository) DeleteReflog(name string) error {
+	if err := os.Remove(repo.reflogPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeEmptyRefDirs(repo.Path("logs"), name)
+	return nil
+}
+
+// RenameReflog move reflog of ref old to ref new, if old has one
+func (repo *Repository) RenameReflog(old, new string) error {
+	np := repo.reflogPath(new)
+	if err := os.MkdirAll(filepath.Dir(np), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(repo.reflogPath(old), np); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeEmptyRefDirs(repo.Path("logs"), old)
+	return nil
+}
+
+// IsZeroOid report whether oid is the all-zero oid standing for no object
+func IsZeroOid(oid []byte) bool {
+	return len(oid) == 0 || bytes.Equal(oid, make([]byte, sha1.Size))
+}
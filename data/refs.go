@@ -0,0 +1,301 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PackedRefsFile holds refs packed by gc, consulted when no loose ref file exists
+const PackedRefsFile = "packed-refs"
+
+const packedRefsHeader = "# pack-refs with: sorted\n"
+
+// packedRefs is parsed packed-refs file, cached until the file changes
+type packedRefs struct {
+	refs  map[string][]byte
+	names []string
+	size  int64
+	mtime time.Time
+}
+
+// CheckRefName validate ref name like `git check-ref-format`.
+// Names outside refs/ must be upper case, like HEAD or MERGE_HEAD.
+func CheckRefName(name string) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("'%s' is not a valid ref name: %s", name, reason)
+	}
+	if len(name) == 0 {
+		return invalid("empty name")
+	}
+	if !strings.Contains(name, "/") {
+		for _, c := range name {
+			if (c < 'A' || c > 'Z') && c != '_' {
+				return invalid("one-level names must be upper case")
+			}
+		}
+		return nil
+	}
+	if name == "@" || strings.Contains(name, "@{") {
+		return invalid("contains '@{'")
+	}
+	if strings.Contains(name, "..") {
+		return invalid("contains '..'")
+	}
+	if strings.HasSuffix(name, ".") {
+		return invalid("ends with '.'")
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return invalid(fmt.Sprintf("contains %q", c))
+		}
+	}
+	for _, comp := range strings.Split(name, "/") {
+		switch {
+		case len(comp) == 0:
+			return invalid("empty path component")
+		case strings.HasPrefix(comp, "."):
+			return invalid("component starts with '.'")
+		case strings.HasSuffix(comp, ".lock"):
+			return invalid("component ends with '.lock'")
+		}
+	}
+	return nil
+}
+
+// readPackedRefs get packed refs, reading the file only when it changed
+func (repo *Repository) readPackedRefs() (*packedRefs, error) {
+	repo.refsMu.Lock()
+	defer repo.refsMu.Unlock()
+	fi, err := os.Stat(repo.Path(PackedRefsFile))
+	if os.IsNotExist(err) {
+		return &packedRefs{refs: map[string][]byte{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p := repo.packed; p != nil && p.size == fi.Size() && p.mtime.Equal(fi.ModTime()) {
+		return p, nil
+	}
+	b, err := ioutil.ReadFile(repo.Path(PackedRefsFile))
+	if err != nil {
+		return nil, err
+	}
+	p := &packedRefs{refs: map[string][]byte{}, size: fi.Size(), mtime: fi.ModTime()}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		// `^` lines carry peeled values of the preceding ref
+		if len(line) == 0 || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		f := strings.SplitN(line, " ", 2)
+		oid, err := hex.DecodeString(f[0])
+		if len(f) != 2 || err != nil || len(oid) != sha1.Size {
+			return nil, fmt.Errorf("%s line %d: invalid entry %q", PackedRefsFile, n, line)
+		}
+		if _, ok := p.refs[f[1]]; !ok {
+			p.names = append(p.names, f[1])
+		}
+		p.refs[f[1]] = oid
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(p.names)
+	repo.packed = p
+	return p, nil
+}
+
+// writePackedRefs replace packed-refs with refs, holding its lock
+func (repo *Repository) writePackedRefs(l *lockFile, refs map[string][]byte) error {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	buf.WriteString(packedRefsHeader)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%x %s\n", refs[name], name)
+	}
+	repo.refsMu.Lock()
+	repo.packed = nil
+	repo.refsMu.Unlock()
+	return l.commit(buf.Bytes())
+}
+
+// HasRef report whether ref exists, loose or packed
+func (repo *Repository) HasRef(name string) bool {
+	if fi, err := os.Stat(repo.Path(name)); err == nil {
+		return !fi.IsDir()
+	}
+	p, err := repo.readPackedRefs()
+	if err != nil {
+		return false
+	}
+	_, ok := p.refs[name]
+	return ok
+}
+
+// listRefNames get sorted names of loose and packed refs under refs/
+func (repo *Repository) listRefNames() ([]string, error) {
+	root := repo.Path("refs")
+	seen := map[string]bool{}
+	names := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := "refs/" + filepath.ToSlash(rel)
+		seen[name] = true
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	p, err := repo.readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range p.names {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// checkRefConflict refuse name when it would nest a ref inside another, like
+// refs/heads/a/b next to refs/heads/a
+func (repo *Repository) checkRefConflict(name string) error {
+	for i := strings.IndexByte(name, '/'); i >= 0; i = nextSlash(name, i) {
+		if parent := name[:i]; strings.Count(parent, "/") >= 2 && repo.HasRef(parent) {
+			return fmt.Errorf("cannot lock ref '%s': '%s' exists; cannot create '%s'", name, parent, name)
+		}
+	}
+	p, err := repo.readPackedRefs()
+	if err != nil {
+		return err
+	}
+	i := sort.SearchStrings(p.names, name+"/")
+	nested := i < len(p.names) && strings.HasPrefix(p.names[i], name+"/")
+	if nested || isDir(repo.Path(name)) {
+		return fmt.Errorf("cannot lock ref '%s': there are refs inside '%s'", name, name)
+	}
+	return nil
+}
+
+func nextSlash(s string, i int) int {
+	j := strings.IndexByte(s[i+1:], '/')
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// removePackedRef drop name from packed-refs, if it is there
+func (repo *Repository) removePackedRef(name string) error {
+	l, err := lock(repo.Path(PackedRefsFile))
+	if err != nil {
+		return err
+	}
+	defer l.rollback()
+	p, err := repo.readPackedRefs()
+	if err != nil {
+		return err
+	}
+	if _, ok := p.refs[name]; !ok {
+		return nil
+	}
+	refs := map[string][]byte{}
+	for n, oid := range p.refs {
+		if n != name {
+			refs[n] = oid
+		}
+	}
+	return repo.writePackedRefs(l, refs)
+}
+
+// removeEmptyRefDirs remove directories of ref name under root left empty,
+// keeping the top level ones like refs/heads
+func removeEmptyRefDirs(root, name string) {
+	for dir := name[:strings.LastIndexByte(name, '/')+1]; strings.Count(dir, "/") > 2; {
+		dir = strings.TrimSuffix(dir, "/")
+		if os.Remove(filepath.Join(root, filepath.FromSlash(dir))) != nil {
+			return
+		}
+		dir = dir[:strings.LastIndexByte(dir, '/')+1]
+	}
+}
+
+// PackRefs move every loose ref under refs/ into packed-refs.
+// Symbolic refs stay loose.
+func (repo *Repository) PackRefs() (int, error) {
+	l, err := lock(repo.Path(PackedRefsFile))
+	if err != nil {
+		return 0, err
+	}
+	defer l.rollback()
+	p, err := repo.readPackedRefs()
+	if err != nil {
+		return 0, err
+	}
+	refs := map[string][]byte{}
+	for n, oid := range p.refs {
+		refs[n] = oid
+	}
+	names, err := repo.listRefNames()
+	if err != nil {
+		return 0, err
+	}
+	loose := map[string][]byte{}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(repo.Path(name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if bytes.HasPrefix(b, []byte("ref:")) || len(b) != sha1.Size {
+			continue
+		}
+		refs[name] = b
+		loose[name] = b
+	}
+	if err := repo.writePackedRefs(l, refs); err != nil {
+		return 0, err
+	}
+	for name, oid := range loose {
+		// a ref updated since it was read keeps its newer loose value
+		rl, err := lock(repo.Path(name))
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(repo.Path(name))
+		if err == nil && bytes.Equal(b, oid) {
+			os.Remove(repo.Path(name))
+		}
+		rl.rollback()
+		removeEmptyRefDirs(repo.GitDir, name)
+	}
+	return len(loose), nil
+}
@@ -0,0 +1,267 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Repository is a git directory and the worktree it belongs to
+type Repository struct {
+	GitDir   string
+	WorkTree string
+	packs    []*packIndex
+	refsMu   sync.Mutex
+	packed   *packedRefs
+}
+
+// Default is repository used by package-level functions,
+// .ugit in current directory unless replaced
+var Default = NewRepository(".")
+
+// NewRepository get repository with worktree root, which may not be initialized yet
+func NewRepository(worktree string) *Repository {
+	return &Repository{GitDir: filepath.Join(worktree, GITDIR), WorkTree: worktree}
+}
+
+// Open open initialized repository with worktree root
+func Open(worktree string) (*Repository, error) {
+	abs, err := filepath.Abs(worktree)
+	if err != nil {
+		return nil, err
+	}
+	repo := NewRepository(abs)
+	if !isDir(repo.GitDir) {
+		return nil, fmt.Errorf("%s is not a ugit repository", abs)
+	}
+	return repo, nil
+}
+
+// Discover find repository containing dir, searching upward for .ugit.
+// UGIT_DIR and UGIT_WORK_TREE override git directory and worktree root.
+func Discover(dir string) (*Repository, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var repo *Repository
+	if gitdir := os.Getenv("UGIT_DIR"); len(gitdir) > 0 {
+		if gitdir, err = filepath.Abs(gitdir); err != nil {
+			return nil, err
+		}
+		if !isDir(gitdir) {
+			return nil, fmt.Errorf("not a ugit repository: %s", gitdir)
+		}
+		repo = &Repository{GitDir: gitdir, WorkTree: dir}
+	} else {
+		for d := dir; repo == nil; d = filepath.Dir(d) {
+			if isDir(filepath.Join(d, GITDIR)) {
+				repo = NewRepository(d)
+			} else if filepath.Dir(d) == d {
+				return nil, fmt.Errorf("not a ugit repository (or any of the parent directories): %s", GITDIR)
+			}
+		}
+	}
+	if worktree := os.Getenv("UGIT_WORK_TREE"); len(worktree) > 0 {
+		if repo.WorkTree, err = filepath.Abs(worktree); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// Path get path of file in git directory
+func (repo *Repository) Path(elem ...string) string {
+	return filepath.Join(append([]string{repo.GitDir}, elem...)...)
+}
+
+// Init initialize .ugit
+func Init() error {
+	return Default.Init()
+}
+
+// HashObject gen hash from data and save data.
+func HashObject(data []byte, dtype Type) ([]byte, error) {
+	return Default.HashObject(data, dtype)
+}
+
+// GetObject get file from hash
+func GetObject(oid []byte, expected Type) ([]byte, error) {
+	return Default.GetObject(oid, expected)
+}
+
+// GetType get data type
+func GetType(oid []byte) (Type, error) {
+	return Default.GetType(oid)
+}
+
+// VerifyObject check that every stored copy of object hashes to its oid
+func VerifyObject(oid []byte) error {
+	return Default.VerifyObject(oid)
+}
+
+// HasObject report whether object is stored, loose or packed
+func HasObject(oid []byte) bool {
+	return Default.HasObject(oid)
+}
+
+// FindObjects get stored objects whose hex oid starts with prefix
+func FindObjects(prefix string) ([][]byte, error) {
+	return Default.FindObjects(prefix)
+}
+
+// UpdateRef update ref, and record the update with reason msg in reflog
+// of the written ref and of the symbolic ref it was reached through
+func UpdateRef(name string, ref RefValue, deref bool, msg string) error {
+	return Default.UpdateRef(name, ref, deref, msg)
+}
+
+// DeleteRef delete ref and its reflog
+func DeleteRef(name string, deref bool) error {
+	return Default.DeleteRef(name, deref)
+}
+
+// CompareAndSwapRef update ref like UpdateRef, only if name currently resolves to old.
+// A nil old skips the check, and the zero oid requires name not to exist.
+func CompareAndSwapRef(name string, old []byte, ref RefValue, deref bool, msg string) error {
+	return Default.CompareAndSwapRef(name, old, ref, deref, msg)
+}
+
+// CompareAndDeleteRef delete ref like DeleteRef, only if name currently resolves to old.
+// A nil old skips the check.
+func CompareAndDeleteRef(name string, old []byte, deref bool) error {
+	return Default.CompareAndDeleteRef(name, old, deref)
+}
+
+// GetRef get ref
+func GetRef(name string, deref bool) (RefValue, error) {
+	return Default.GetRef(name, deref)
+}
+
+// AppendReflog record update of ref from old to new oid, nil meaning none
+func AppendReflog(name string, old, new []byte, msg string) error {
+	return Default.AppendReflog(name, old, new, msg)
+}
+
+// ReadReflog get recorded updates of ref, oldest first
+func ReadReflog(name string) ([]ReflogEntry, error) {
+	return Default.ReadReflog(name)
+}
+
+// ListReflogs get names of refs which have a reflog
+func ListReflogs() ([]string, error) {
+	return Default.ListReflogs()
+}
+
+// DeleteReflog remove reflog of ref
+func DeleteReflog(name string) error {
+	return Default.DeleteReflog(name)
+}
+
+// RenameReflog move reflog of ref old to ref new, if old has one
+func RenameReflog(old, new string) error {
+	return Default.RenameReflog(old, new)
+}
+
+// HasRef report whether ref exists, loose or packed
+func HasRef(name string) bool {
+	return Default.HasRef(name)
+}
+
+// PackRefs move every loose ref under refs/ into packed-refs.
+// Symbolic refs stay loose.
+func PackRefs() (int, error) {
+	return Default.PackRefs()
+}
+
+// IsLegacyTree report whether tree is stored in legacy format
+func IsLegacyTree(oid []byte) (bool, error) {
+	return Default.IsLegacyTree(oid)
+}
+
+// GetTreeEntries get entries
+func GetTreeEntries(oid []byte) ([]Entry, error) {
+	return Default.GetTreeEntries(oid)
+}
+
+// HashTreeEntries set entries. Entries without mode get one from object type.
+func HashTreeEntries(ents []Entry) ([]byte, error) {
+	return Default.HashTreeEntries(ents)
+}
+
+// GetRefs get refs
+func GetRefs(prefix string, deref bool) ([]string, []RefValue, error) {
+	return Default.GetRefs(prefix, deref)
+}
+
+// ListRefNames list names of existing refs, including HEAD
+func ListRefNames() ([]string, error) {
+	return Default.ListRefNames()
+}
+
+// GetConfig get config value from repository config, then ~/.ugitconfig
+func GetConfig(key string) (string, error) {
+	return Default.GetConfig(key)
+}
+
+// SetConfig set config value in repository config
+func SetConfig(key, value string) error {
+	return Default.SetConfig(key, value)
+}
+
+// GetIdent get identity from environment or config
+func GetIdent(role Role) (Signature, error) {
+	return Default.GetIdent(role)
+}
+
+// ReadIndex read index
+func ReadIndex() ([]IndexEntry, error) {
+	return Default.ReadIndex()
+}
+
+// WriteIndex write index, sorted by path
+func WriteIndex(ents []IndexEntry) error {
+	return Default.WriteIndex(ents)
+}
+
+// ListLooseObjects list oids stored as loose objects, in both layouts
+func ListLooseObjects() ([][]byte, error) {
+	return Default.ListLooseObjects()
+}
+
+// IsLoose report whether object is stored as loose object
+func IsLoose(oid []byte) bool {
+	return Default.IsLoose(oid)
+}
+
+// RemoveLooseObject delete loose copies of object
+func RemoveLooseObject(oid []byte) error {
+	return Default.RemoveLooseObject(oid)
+}
+
+// LooseObjectTime get modification time of loose object
+func LooseObjectTime(oid []byte) (time.Time, error) {
+	return Default.LooseObjectTime(oid)
+}
+
+// ListPackedObjects list oids in every pack
+func ListPackedObjects() ([][]byte, error) {
+	return Default.ListPackedObjects()
+}
+
+// WritePack store objects in a new pack with delta compression, and return its name
+func WritePack(oids [][]byte) (string, error) {
+	return Default.WritePack(oids)
+}
+
+// LoadStatCache load stat cache, or empty one if missing or unreadable
+func LoadStatCache() *StatCache {
+	return Default.LoadStatCache()
+}
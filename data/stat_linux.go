@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+func statExtra(fi os.FileInfo) (int64, uint64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return st.Ctim.Nano(), st.Ino
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package data
+
+import (
+	"os"
+)
+
+func statExtra(fi os.FileInfo) (int64, uint64) {
+	return fi.ModTime().UnixNano(), 0
+}
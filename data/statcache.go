@@ -0,0 +1,84 @@
+package data
+
+import (
+	"os"
+	"time"
+)
+
+var statCacheMagic = []byte("USTC")
+
+// racyWindow is how recent a modification must be to distrust its stat data
+const racyWindow = 2 * time.Second
+
+// StatCache remember blob oids of files keyed by path and stat data
+type StatCache struct {
+	path    string
+	entries map[string]IndexEntry
+	used    map[string]bool
+	dirty   bool
+}
+
+// LoadStatCache load stat cache, or empty one if missing or unreadable
+func (repo *Repository) LoadStatCache() *StatCache {
+	p := repo.Path("stat-cache")
+	c := &StatCache{path: p, entries: map[string]IndexEntry{}, used: map[string]bool{}}
+	ents, err := readEntries(p, statCacheMagic)
+	if err != nil {
+		return c
+	}
+	for _, e := range ents {
+		c.entries[e.Path] = e
+	}
+	return c
+}
+
+// Lookup get cached oid if file's size, mtime, ctime, inode and mode are unchanged
+func (c *StatCache) Lookup(path string, fi os.FileInfo) ([]byte, bool) {
+	c.used[path] = true
+	e, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	cur := NewIndexEntry(path, e.Oid, fi)
+	if cur.Mode != e.Mode || cur.Size != e.Size || cur.Mtime != e.Mtime || cur.Ctime != e.Ctime || cur.Ino != e.Ino {
+		return nil, false
+	}
+	return e.Oid, true
+}
+
+// Store remember oid of file. Files modified too recently are not cached,
+// since a later change within the timestamp granularity would go unnoticed.
+func (c *StatCache) Store(path string, oid []byte, fi os.FileInfo) {
+	c.used[path] = true
+	if time.Since(fi.ModTime()) < racyWindow {
+		if _, ok := c.entries[path]; ok {
+			delete(c.entries, path)
+			c.dirty = true
+		}
+		return
+	}
+	c.entries[path] = NewIndexEntry(path, oid, fi)
+	c.dirty = true
+}
+
+// Prune forget paths not looked up since loading
+func (c *StatCache) Prune() {
+	for p := range c.entries {
+		if !c.used[p] {
+			delete(c.entries, p)
+			c.dirty = true
+		}
+	}
+}
+
+// Save write stat cache if changed
+func (c *StatCache) Save() error {
+	if !c.dirty {
+		return nil
+	}
+	ents := make([]IndexEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		ents = append(ents, e)
+	}
+	return writeEntries(c.path, statCacheMagic, ents)
+}
@@ -3,102 +3,84 @@ package diff
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"path/filepath"
 
 	data "github.com/KoyamaSohei/ugit/data"
 )
 
-func getBlobsDiff(poid, noid []byte, name string) (string, error) {
-	po, err := data.GetObject(poid, data.Blob)
+func getBlobsDiff(repo *data.Repository, poid, noid []byte, name string, opt Options) (string, error) {
+	po, err := repo.GetObject(poid, data.Blob)
 	if err != nil {
 		return "", err
 	}
-	no, err := data.GetObject(noid, data.Blob)
+	no, err := repo.GetObject(noid, data.Blob)
 	if err != nil {
 		return "", err
 	}
-	dir := filepath.Dir(name)
-	pname := fmt.Sprintf("%s.prev", filepath.Base(name))
-	ptmp, err := ioutil.TempFile(dir, pname)
-	if err != nil {
-		return "", err
-	}
-	defer os.Remove(ptmp.Name())
-	nname := fmt.Sprintf("%s.next", filepath.Base(name))
-	ntmp, err := ioutil.TempFile(dir, nname)
-	if err != nil {
-		return "", err
-	}
-	defer os.Remove(ntmp.Name())
-	if _, err := ptmp.Write(po); err != nil {
-		return "", err
-	}
-	if _, err := ntmp.Write(no); err != nil {
-		return "", err
-	}
-	diff := exec.Command("diff", "--unified", "--show-c-function", "--label", filepath.Join(dir, pname), ptmp.Name(), "--label", filepath.Join(dir, nname), ntmp.Name())
-	out, _ := diff.Output()
-	return string(out), nil
+	return Unified(po, no, fmt.Sprintf("a/%s", name), fmt.Sprintf("b/%s", name), opt), nil
+}
+
+// GetTreesDiff return diff of trees stored in repo
+func GetTreesDiff(repo *data.Repository, ptoid, ntoid []byte, opt Options) (string, error) {
+	return getTreesDiff(repo, ptoid, ntoid, "", opt)
 }
 
-// GetTreesDiff return tree's diff
-func GetTreesDiff(ptoid, ntoid []byte) (string, error) {
+func getTreesDiff(repo *data.Repository, ptoid, ntoid []byte, dir string, opt Options) (string, error) {
 	out := ""
-	pent, err := data.GetTreeEntries(ptoid)
+	pent, err := repo.GetTreeEntries(ptoid)
 	if err != nil {
 		return "", err
 	}
-	nent, err := data.GetTreeEntries(ntoid)
+	nent, err := repo.GetTreeEntries(ntoid)
 	if err != nil {
 		return "", err
 	}
-	pmap := map[string][]byte{}
+	pmap := map[string]data.Entry{}
 	used := map[string]bool{}
 	for _, e := range pent {
-		pmap[e.Name] = e.Oid
-		used[e.Name] = false
+		pmap[e.Name] = e
 	}
 	for _, e := range nent {
-		po, ok := pmap[e.Name]
+		name := e.Name
+		if len(dir) > 0 {
+			name = dir + "/" + e.Name
+		}
+		pe, ok := pmap[e.Name]
 		if !ok {
-			out += fmt.Sprintf("new file %s\n", e.Name)
+			out += fmt.Sprintf("new file %s\n", name)
 			continue
 		}
 		used[e.Name] = true
+		po := pe.Oid
+		if pe.Mode != e.Mode && pe.Mode != data.ModeTree && e.Mode != data.ModeTree {
+			out += fmt.Sprintf("mode change %o => %o %s\n", pe.Mode, e.Mode, name)
+		}
 		if bytes.Equal(e.Oid, po) {
 			continue
 		}
-		pt, err := data.GetType(po)
-		if err != nil {
-			return "", err
-		}
-		nt, err := data.GetType(e.Oid)
-		if err != nil {
-			return "", err
-		}
-		if pt == data.Blob && nt == data.Blob {
-			cout, err := getBlobsDiff(po, e.Oid, e.Name)
+		if pe.Mode != data.ModeTree && e.Mode != data.ModeTree {
+			cout, err := getBlobsDiff(repo, po, e.Oid, name, opt)
 			if err != nil {
 				return "", err
 			}
 			out += cout
 			continue
 		}
-		if pt != data.Tree || nt != data.Tree {
-			out += fmt.Sprintf("mod file %s\n", e.Name)
+		if pe.Mode != data.ModeTree || e.Mode != data.ModeTree {
+			out += fmt.Sprintf("mod file %s\n", name)
 			continue
 		}
-		cout, err := GetTreesDiff(po, e.Oid)
+		cout, err := getTreesDiff(repo, po, e.Oid, name, opt)
 		if err != nil {
 			return "", err
 		}
 		out += cout
 	}
-	for name, u := range used {
-		if !u {
+	for _, e := range pent {
+		if !used[e.Name] {
+			name := e.Name
+			if len(dir) > 0 {
+				name = dir + "/" + e.Name
+			}
 			out += fmt.Sprintf("del file %s\n", name)
 		}
 	}
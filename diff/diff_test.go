@@ -0,0 +1,33 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	data "github.com/KoyamaSohei/ugit/data"
+)
+
+func TestTreesDiffRepository(t *testing.T) {
+	repo := data.NewRepository(t.TempDir())
+	if err := repo.Init(); err != nil {
+		t.Fatal(err)
+	}
+	tree := func(content string) []byte {
+		b, err := repo.HashObject([]byte(content), data.Blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oid, err := repo.HashTreeEntries([]data.Entry{{Oid: b, Name: "f", Mode: data.ModeFile}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return oid
+	}
+	out, err := GetTreesDiff(repo, tree("one\n"), tree("two\n"), DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "-one\n+two\n") {
+		t.Fatalf("diff = %q, want f changed from one to two", out)
+	}
+}
@@ -0,0 +1,59 @@
+package diff
+
+// maxChainLength bound occurrences considered per line, like JGit
+const maxChainLength = 64
+
+// Histogram compute edit script anchored on the least frequent common lines
+func Histogram(a, b []string) []Op {
+	return withCommonAffix(a, b, histogram)
+}
+
+func histogram(a, b []string) []Op {
+	if len(a) == 0 || len(b) == 0 {
+		return appendOps(appendOps(nil, Delete, len(a)), Insert, len(b))
+	}
+	pos := map[string][]int{}
+	for i, l := range a {
+		pos[l] = append(pos[l], i)
+	}
+	as, bs, n, best := 0, 0, 0, maxChainLength+1
+	for j := 0; j < len(b); {
+		next := j + 1
+		occ := pos[b[j]]
+		if len(occ) == 0 || len(occ) > best {
+			j = next
+			continue
+		}
+		for _, i := range occ {
+			s, t := i, j
+			for s > 0 && t > 0 && a[s-1] == b[t-1] {
+				s--
+				t--
+			}
+			e, f := i+1, j+1
+			for e < len(a) && f < len(b) && a[e] == b[f] {
+				e++
+				f++
+			}
+			rc := best
+			for x := s; x < e; x++ {
+				if c := len(pos[a[x]]); c < rc {
+					rc = c
+				}
+			}
+			if rc < best || (rc == best && e-s > n) {
+				as, bs, n, best = s, t, e-s, rc
+			}
+			if f > next {
+				next = f
+			}
+		}
+		j = next
+	}
+	if n == 0 {
+		return myers(a, b)
+	}
+	ops := Histogram(a[:as], b[:bs])
+	ops = appendOps(ops, Equal, n)
+	return append(ops, Histogram(a[as+n:], b[bs+n:])...)
+}
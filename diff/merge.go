@@ -0,0 +1,70 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Merge3 merge changes of ours and theirs against base line by line.
+// Hunks changed differently on both sides are written with conflict markers.
+func Merge3(base, ours, theirs []byte, oursLabel, theirsLabel string) ([]byte, bool) {
+	o, a, b := SplitLines(base), SplitLines(ours), SplitLines(theirs)
+	ma := matches(Myers(o, a), len(o))
+	mb := matches(Myers(o, b), len(o))
+
+	out := strings.Builder{}
+	conflict := false
+	i, j, k := 0, 0, 0
+	for i < len(o) || j < len(a) || k < len(b) {
+		if i < len(o) && ma[i] == j && mb[i] == k {
+			out.WriteString(o[i])
+			i, j, k = i+1, j+1, k+1
+			continue
+		}
+		ni, nj, nk := len(o), len(a), len(b)
+		for x := i; x < len(o); x++ {
+			if ma[x] >= 0 && mb[x] >= 0 {
+				ni, nj, nk = x, ma[x], mb[x]
+				break
+			}
+		}
+		oc, ac, bc := o[i:ni], a[j:nj], b[k:nk]
+		switch {
+		case equalLines(oc, ac):
+			writeLines(&out, bc, false)
+		case equalLines(oc, bc), equalLines(ac, bc):
+			writeLines(&out, ac, false)
+		default:
+			conflict = true
+			out.WriteString(fmt.Sprintf("<<<<<<< %s\n", oursLabel))
+			writeLines(&out, ac, true)
+			out.WriteString("=======\n")
+			writeLines(&out, bc, true)
+			out.WriteString(fmt.Sprintf(">>>>>>> %s\n", theirsLabel))
+		}
+		i, j, k = ni, nj, nk
+	}
+	return []byte(out.String()), conflict
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeLines write lines, terminating the last one if markers follow
+func writeLines(out *strings.Builder, lines []string, terminate bool) {
+	for _, l := range lines {
+		out.WriteString(l)
+	}
+	if n := len(lines); terminate && n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		out.WriteString("\n")
+	}
+}
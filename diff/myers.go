@@ -0,0 +1,208 @@
+package diff
+
+import (
+	"bytes"
+)
+
+// Op is edit operation
+type Op byte
+
+const (
+	// Equal keeps line
+	Equal Op = iota
+	// Delete removes line of a
+	Delete
+	// Insert adds line of b
+	Insert
+)
+
+// SplitLines split data into lines, keeping newlines
+func SplitLines(b []byte) []string {
+	lines := make([]string, 0)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			lines = append(lines, string(b))
+			break
+		}
+		lines = append(lines, string(b[:i+1]))
+		b = b[i+1:]
+	}
+	return lines
+}
+
+// Myers compute shortest edit script turning a into b
+func Myers(a, b []string) []Op {
+	return withCommonAffix(a, b, myers)
+}
+
+// withCommonAffix strip common prefix and suffix before running diff algorithm
+func withCommonAffix(a, b []string, f func(a, b []string) []Op) []Op {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ops := make([]Op, 0, len(a)+len(b))
+	ops = appendOps(ops, Equal, pre)
+	ops = append(ops, f(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	return appendOps(ops, Equal, suf)
+}
+
+func appendOps(ops []Op, op Op, n int) []Op {
+	for i := 0; i < n; i++ {
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// myers run linear space Myers diff: find the middle of a shortest edit path
+// by searching from both ends, and diff the halves before and after it
+func myers(a, b []string) []Op {
+	ids := map[string]int{}
+	intern := func(lines []string) []int {
+		res := make([]int, len(lines))
+		for i, l := range lines {
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			res[i] = id
+		}
+		return res
+	}
+	ai := intern(a)
+	seen := len(ids)
+	bi := intern(b)
+	ops := make([]Op, 0, len(a)+len(b))
+	for _, id := range bi {
+		if id < seen {
+			return bisectDiff(ops, ai, bi)
+		}
+	}
+	// a full rewrite needs no search
+	return appendOps(appendOps(ops, Delete, len(a)), Insert, len(b))
+}
+
+// bisectDiff append ops turning a into b
+func bisectDiff(ops []Op, a, b []int) []Op {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ops = appendOps(ops, Equal, pre)
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+	x, y := -1, -1
+	if len(a) > 0 && len(b) > 0 {
+		x, y = bisect(a, b)
+	}
+	// without a split inside, there is nothing in common
+	if x <= 0 && y <= 0 || x >= len(a) && y >= len(b) {
+		ops = appendOps(appendOps(ops, Delete, len(a)), Insert, len(b))
+	} else {
+		ops = bisectDiff(ops, a[:x], b[:y])
+		ops = bisectDiff(ops, a[x:], b[y:])
+	}
+	return appendOps(ops, Equal, suf)
+}
+
+// bisect find where forward and reverse furthest reaching paths meet,
+// or -1, -1 if they do not
+func bisect(a, b []int) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	off := maxD
+	vf := make([]int, 2*maxD+2)
+	vr := make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vr[i] = -1, -1
+	}
+	vf[off+1], vr[off+1] = 0, 0
+	delta := n - m
+	// with odd delta the paths meet on a forward step, otherwise on a reverse one
+	odd := delta%2 != 0
+	// bounds of diagonals still inside the edit graph
+	kfStart, kfEnd, krStart, krEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + kfStart; k <= d-kfEnd; k += 2 {
+			i := off + k
+			x := 0
+			if k == -d || (k != d && vf[i-1] < vf[i+1]) {
+				x = vf[i+1]
+			} else {
+				x = vf[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[i] = x
+			switch {
+			case x > n:
+				kfEnd += 2
+			case y > m:
+				kfStart += 2
+			case odd:
+				if j := off + delta - k; j >= 0 && j < len(vr) && vr[j] != -1 && x >= n-vr[j] {
+					return x, y
+				}
+			}
+		}
+		for k := -d + krStart; k <= d-krEnd; k += 2 {
+			i := off + k
+			x := 0
+			if k == -d || (k != d && vr[i-1] < vr[i+1]) {
+				x = vr[i+1]
+			} else {
+				x = vr[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			vr[i] = x
+			switch {
+			case x > n:
+				krEnd += 2
+			case y > m:
+				krStart += 2
+			case !odd:
+				if j := off + delta - k; j >= 0 && j < len(vf) && vf[j] != -1 && vf[j] >= n-x {
+					fx := vf[j]
+					return fx, fx - (j - off)
+				}
+			}
+		}
+	}
+	return -1, -1
+}
+
+// matches map each line of a to its equal line of b, or -1
+func matches(ops []Op, n int) []int {
+	match := make([]int, n)
+	i, j := 0, 0
+	for _, op := range ops {
+		switch op {
+		case Equal:
+			match[i] = j
+			i++
+			j++
+		case Delete:
+			match[i] = -1
+			i++
+		case Insert:
+			j++
+		}
+	}
+	return match
+}
@@ -0,0 +1,102 @@
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// lcs get length of longest common subsequence by dynamic programming
+func lcs(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// checkOps verify ops turn a into b, and return number of edits
+func checkOps(t *testing.T, a, b []string, ops []Op) int {
+	t.Helper()
+	i, j, edits := 0, 0, 0
+	for _, op := range ops {
+		switch op {
+		case Equal:
+			if i >= len(a) || j >= len(b) || a[i] != b[j] {
+				t.Fatalf("bad equal at %d,%d: %v -> %v: %v", i, j, a, b, ops)
+			}
+			i++
+			j++
+		case Delete:
+			i++
+			edits++
+		case Insert:
+			j++
+			edits++
+		}
+	}
+	if i != len(a) || j != len(b) {
+		t.Fatalf("ops end at %d,%d of %d,%d: %v -> %v: %v", i, j, len(a), len(b), a, b, ops)
+	}
+	return edits
+}
+
+func TestMyersShortest(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	gen := func() []string {
+		lines := make([]string, r.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + r.Intn(4)))
+		}
+		return lines
+	}
+	for n := 0; n < 2000; n++ {
+		a, b := gen(), gen()
+		edits := checkOps(t, a, b, Myers(a, b))
+		if want := len(a) + len(b) - 2*lcs(a, b); edits != want {
+			t.Fatalf("%v -> %v: %d edits, want %d", a, b, edits, want)
+		}
+	}
+}
+
+// rewrite get n lines, and the same lines all changed but every keep-th one
+func rewrite(n, keep int) ([]string, []string) {
+	a, b := make([]string, n), make([]string, n)
+	for i := range a {
+		a[i] = fmt.Sprintf("old %d\n", i)
+		b[i] = fmt.Sprintf("new %d\n", i)
+		if i%keep == keep-1 {
+			b[i] = a[i]
+		}
+	}
+	return a, b
+}
+
+func TestMyersLargeRewrite(t *testing.T) {
+	for _, keep := range []int{5000 + 1, 500} {
+		a, b := rewrite(5000, keep)
+		kept := 5000 / keep
+		if edits := checkOps(t, a, b, Myers(a, b)); edits != 2*(5000-kept) {
+			t.Fatalf("keeping every %d lines: %d edits, want %d", keep, edits, 2*(5000-kept))
+		}
+	}
+}
+
+func BenchmarkMyersRewrite(b *testing.B) {
+	x, y := rewrite(20000, 1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Myers(x, y)
+	}
+}
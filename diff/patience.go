@@ -0,0 +1,84 @@
+package diff
+
+import (
+	"sort"
+)
+
+// Patience compute edit script anchored on lines unique to both sides
+func Patience(a, b []string) []Op {
+	return withCommonAffix(a, b, patience)
+}
+
+func patience(a, b []string) []Op {
+	if len(a) == 0 || len(b) == 0 {
+		return appendOps(appendOps(nil, Delete, len(a)), Insert, len(b))
+	}
+	type count struct {
+		a, b   int
+		ai, bi int
+	}
+	counts := map[string]*count{}
+	for i, l := range a {
+		c, ok := counts[l]
+		if !ok {
+			c = &count{}
+			counts[l] = c
+		}
+		c.a++
+		c.ai = i
+	}
+	for j, l := range b {
+		if c, ok := counts[l]; ok {
+			c.b++
+			c.bi = j
+		}
+	}
+	// unique common lines in order of a
+	pairs := [][2]int{}
+	for _, c := range counts {
+		if c.a == 1 && c.b == 1 {
+			pairs = append(pairs, [2]int{c.ai, c.bi})
+		}
+	}
+	if len(pairs) == 0 {
+		return myers(a, b)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i][0] < pairs[j][0]
+	})
+	anchors := longestIncreasing(pairs)
+
+	ops := make([]Op, 0, len(a)+len(b))
+	i, j := 0, 0
+	for _, p := range anchors {
+		ops = append(ops, Patience(a[i:p[0]], b[j:p[1]])...)
+		ops = append(ops, Equal)
+		i, j = p[0]+1, p[1]+1
+	}
+	return append(ops, Patience(a[i:], b[j:])...)
+}
+
+// longestIncreasing pick longest subsequence of pairs increasing in b, by patience sorting
+func longestIncreasing(pairs [][2]int) [][2]int {
+	tops := []int{}
+	prev := make([]int, len(pairs))
+	for k, p := range pairs {
+		n := sort.Search(len(tops), func(x int) bool {
+			return pairs[tops[x]][1] > p[1]
+		})
+		prev[k] = -1
+		if n > 0 {
+			prev[k] = tops[n-1]
+		}
+		if n == len(tops) {
+			tops = append(tops, k)
+		} else {
+			tops[n] = k
+		}
+	}
+	res := make([][2]int, len(tops))
+	for k, n := tops[len(tops)-1], len(tops)-1; k >= 0; k, n = prev[k], n-1 {
+		res[n] = pairs[k]
+	}
+	return res
+}
@@ -0,0 +1,165 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Algorithm is line diff algorithm
+type Algorithm string
+
+const (
+	// AlgorithmMyers is the O(ND) shortest edit script
+	AlgorithmMyers Algorithm = "myers"
+	// AlgorithmPatience anchors on unique lines
+	AlgorithmPatience Algorithm = "patience"
+	// AlgorithmHistogram anchors on least frequent lines
+	AlgorithmHistogram Algorithm = "histogram"
+)
+
+// Options is diff output options
+type Options struct {
+	Context   int
+	Algorithm Algorithm
+}
+
+// DefaultOptions is options used when nothing is configured
+var DefaultOptions = Options{Context: 3, Algorithm: AlgorithmMyers}
+
+// ParseAlgorithm get algorithm by name
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch a := Algorithm(name); a {
+	case AlgorithmMyers, AlgorithmPatience, AlgorithmHistogram:
+		return a, nil
+	case "default", "minimal":
+		return AlgorithmMyers, nil
+	}
+	return "", fmt.Errorf("unknown diff algorithm %s", name)
+}
+
+// Lines compute edit script between lines with algorithm
+func Lines(a, b []string, alg Algorithm) []Op {
+	switch alg {
+	case AlgorithmPatience:
+		return Patience(a, b)
+	case AlgorithmHistogram:
+		return Histogram(a, b)
+	}
+	return Myers(a, b)
+}
+
+// Unified format differences between a and b as unified diff
+func Unified(a, b []byte, aname, bname string, opt Options) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+	if bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(b, 0) >= 0 {
+		return fmt.Sprintf("Binary files %s and %s differ\n", aname, bname)
+	}
+	al, bl := SplitLines(a), SplitLines(b)
+	ops := Lines(al, bl, opt.Algorithm)
+	ctx := opt.Context
+	if ctx < 0 {
+		ctx = 0
+	}
+
+	// line numbers of a and b before each op
+	ai := make([]int, len(ops)+1)
+	bi := make([]int, len(ops)+1)
+	for k, op := range ops {
+		ai[k+1], bi[k+1] = ai[k], bi[k]
+		if op != Insert {
+			ai[k+1]++
+		}
+		if op != Delete {
+			bi[k+1]++
+		}
+	}
+
+	out := strings.Builder{}
+	out.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", aname, bname))
+	for k := 0; k < len(ops); {
+		if ops[k] == Equal {
+			k++
+			continue
+		}
+		s := k - ctx
+		if s < 0 {
+			s = 0
+		}
+		// extend hunk while next change is within 2*ctx lines
+		e := k
+		for x := k; x < len(ops); x++ {
+			if ops[x] != Equal {
+				e = x
+				continue
+			}
+			if x-e > 2*ctx {
+				break
+			}
+		}
+		e += ctx + 1
+		if e > len(ops) {
+			e = len(ops)
+		}
+		out.WriteString(hunkHeader(al, ai[s], ai[e]-ai[s], bi[s], bi[e]-bi[s]))
+		for x := s; x < e; x++ {
+			switch ops[x] {
+			case Equal:
+				writeLine(&out, ' ', al[ai[x]])
+			case Delete:
+				writeLine(&out, '-', al[ai[x]])
+			case Insert:
+				writeLine(&out, '+', bl[bi[x]])
+			}
+		}
+		k = e
+	}
+	return out.String()
+}
+
+func hunkHeader(a []string, as, an, bs, bn int) string {
+	h := fmt.Sprintf("@@ -%s +%s @@", hunkRange(as, an), hunkRange(bs, bn))
+	if f := funcContext(a, as); len(f) > 0 {
+		h += " " + f
+	}
+	return h + "\n"
+}
+
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// funcContext find nearest line above the hunk that looks like a function header,
+// the same heuristic as `diff --show-c-function`
+func funcContext(a []string, before int) string {
+	for i := before - 1; i >= 0; i-- {
+		l := strings.TrimRight(a[i], "\r\n")
+		if len(l) == 0 {
+			continue
+		}
+		c := l[0]
+		if c == '_' || c == '$' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if len(l) > 40 {
+				l = l[:40]
+			}
+			return l
+		}
+	}
+	return ""
+}
+
+func writeLine(out *strings.Builder, prefix byte, l string) {
+	out.WriteByte(prefix)
+	out.WriteString(l)
+	if !strings.HasSuffix(l, "\n") {
+		out.WriteString("\n\\ No newline at end of file\n")
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	base "github.com/KoyamaSohei/ugit/base"
 	data "github.com/KoyamaSohei/ugit/data"
@@ -12,10 +16,57 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// setupRepository apply -C and --git-dir, then discover repository
+// containing current directory for commands that need one
+func setupRepository(cmd *cobra.Command, args []string) {
+	if dir, _ := cmd.Flags().GetString("chdir"); len(dir) > 0 {
+		if err := os.Chdir(dir); err != nil {
+			panic(err)
+		}
+	}
+	if gitdir, _ := cmd.Flags().GetString("git-dir"); len(gitdir) > 0 {
+		os.Setenv("UGIT_DIR", gitdir)
+	}
+	if cmd == cmd.Root() || cmd.Name() == "init" || cmd.Name() == "help" {
+		return
+	}
+	repo, err := data.Discover(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+		os.Exit(128)
+	}
+	data.Default = repo
+}
+
+// repoPaths convert paths relative to current directory into paths relative to worktree root
+func repoPaths(paths []string) []string {
+	pwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	res := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(pwd, p)
+		}
+		rel, err := filepath.Rel(data.Default.WorkTree, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			panic(fmt.Errorf("%s is outside repository", p))
+		}
+		res = append(res, filepath.ToSlash(rel))
+	}
+	return res
+}
+
 func initHandler(cmd *cobra.Command, args []string) {
-	base.Init()
 	pwd, _ := os.Getwd()
-	fmt.Printf("Initialized empty ugit repository in %s/%s\n", pwd, data.GITDIR)
+	repo := data.NewRepository(pwd)
+	if gitdir := os.Getenv("UGIT_DIR"); len(gitdir) > 0 {
+		repo.GitDir, _ = filepath.Abs(gitdir)
+	}
+	data.Default = repo
+	base.Init()
+	fmt.Printf("Initialized empty ugit repository in %s\n", repo.GitDir)
 }
 
 func hashHandler(cmd *cobra.Command, args []string) {
@@ -43,7 +94,7 @@ func catHandler(cmd *cobra.Command, args []string) {
 }
 
 func writeHandler(cmd *cobra.Command, args []string) {
-	h, err := base.WriteTree(".")
+	h, err := base.WriteIndexTree()
 	if err != nil {
 		panic(err)
 	}
@@ -55,39 +106,88 @@ func readHandler(cmd *cobra.Command, args []string) {
 	if err != nil {
 		panic(err)
 	}
+	if oid, err = base.Peel(oid, data.Tree); err != nil {
+		panic(err)
+	}
 	base.ClearDirectory(".")
-	base.ReadTree(oid)
+	if err := base.ReadTree(oid); err != nil {
+		panic(err)
+	}
+	if err := base.ResetIndex(oid); err != nil {
+		panic(err)
+	}
 }
 
 func commitHandler(cmd *cobra.Command, args []string) {
-	base.Commit(args[0])
+	author, err := data.GetIdent(data.Author)
+	if err != nil {
+		panic(err)
+	}
+	if a, _ := cmd.Flags().GetString("author"); len(a) > 0 {
+		id, err := data.ParseIdent(a)
+		if err != nil {
+			panic(err)
+		}
+		author.Name, author.Email = id.Name, id.Email
+	}
+	if d, _ := cmd.Flags().GetString("date"); len(d) > 0 {
+		if author.When, err = data.ParseDate(d); err != nil {
+			panic(err)
+		}
+	}
+	if len(args) == 0 {
+		mes, err := ioutil.ReadFile(data.Default.Path("MERGE_MSG"))
+		if err != nil {
+			panic(fmt.Errorf("commit message is required"))
+		}
+		args = append(args, string(mes))
+	}
+	if _, err := base.Commit(args[0], author); err != nil {
+		panic(err)
+	}
 }
 
-func logHandler(cmd *cobra.Command, args []string) {
-	if len(args) == 0 {
-		args = append(args, "@")
+func mergeHandler(cmd *cobra.Command, args []string) {
+	author, err := data.GetIdent(data.Author)
+	if err != nil {
+		panic(err)
+	}
+	err = base.Merge(args[0], author)
+	if cerr, ok := err.(*base.CheckoutError); ok {
+		fmt.Fprintf(os.Stderr, "error: %v\n", cerr)
+		os.Exit(1)
 	}
-	oid, err := base.GetOid(args[0])
 	if err != nil {
 		panic(err)
 	}
-	t, err := data.GetType(oid)
+}
+
+func logHandler(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		args = append(args, "@")
+	}
+	r, isRange, err := base.ParseRange(args[0])
 	if err != nil {
 		panic(err)
 	}
-	if t != data.Commit {
-		panic(fmt.Errorf("hash type is %d,not Commit", t))
+	if !isRange {
+		if r.To, err = base.GetOid(args[0]); err != nil {
+			panic(err)
+		}
+		if r.To, err = base.Peel(r.To, data.Commit); err != nil {
+			panic(err)
+		}
 	}
-	oids2ref := map[string][]string{}
-	names, refs, err := data.GetRefs("", true)
+	oids2ref, err := base.GetDecorations()
 	if err != nil {
 		panic(err)
 	}
-	for i, ref := range refs {
-		oids := fmt.Sprintf("%x", ref.Value)
-		oids2ref[oids] = append(oids2ref[oids], names[i])
+	var oidset [][]byte
+	if isRange {
+		oidset, err = base.GetRangeCommits(r)
+	} else {
+		oidset, err = base.GetCommitsAndParents([][]byte{r.To})
 	}
-	oidset, err := base.GetCommitsAndParents([][]byte{oid})
 	if err != nil {
 		panic(err)
 	}
@@ -99,12 +199,58 @@ func logHandler(cmd *cobra.Command, args []string) {
 }
 
 func checkoutHandler(cmd *cobra.Command, args []string) {
-	if err := base.Checkout(args[0]); err != nil {
+	force, _ := cmd.Flags().GetBool("force")
+	merge, _ := cmd.Flags().GetBool("merge")
+	err := base.Checkout(args[0], base.CheckoutOptions{Force: force, Merge: merge})
+	if cerr, ok := err.(*base.CheckoutError); ok {
+		fmt.Fprintf(os.Stderr, "error: %v\n", cerr)
+		os.Exit(1)
+	}
+	if err != nil {
 		panic(err)
 	}
 }
 
 func tagHandler(cmd *cobra.Command, args []string) {
+	annotate, _ := cmd.Flags().GetBool("annotate")
+	msg, _ := cmd.Flags().GetString("message")
+	list, _ := cmd.Flags().GetBool("list")
+	del, _ := cmd.Flags().GetBool("delete")
+	force, _ := cmd.Flags().GetBool("force")
+	switch {
+	case del:
+		if len(args) == 0 {
+			panic(fmt.Errorf("usage: ugit tag -d <tagname>..."))
+		}
+		for _, name := range args {
+			oid, err := base.DeleteTag(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Deleted tag '%s' (was %s)\n", name, base.ShortOid(oid))
+		}
+		return
+	case list || len(args) == 0:
+		if len(args) > 1 {
+			panic(fmt.Errorf("usage: ugit tag -l [<pattern>]"))
+		}
+		pattern := ""
+		if len(args) == 1 {
+			pattern = args[0]
+		}
+		tags, err := base.ListTags(pattern)
+		if err != nil {
+			panic(err)
+		}
+		for _, t := range tags {
+			fmt.Println(t)
+		}
+		return
+	}
+	if len(args) > 2 {
+		panic(fmt.Errorf("usage: ugit tag [-a -m <msg>] <tagname> [<rev>]"))
+	}
 	if len(args) == 1 {
 		args = append(args, "@")
 	}
@@ -112,7 +258,18 @@ func tagHandler(cmd *cobra.Command, args []string) {
 	if err != nil {
 		panic(err)
 	}
-	base.CreateTag(args[0], oid)
+	if annotate || cmd.Flags().Changed("message") {
+		if len(msg) == 0 {
+			panic(fmt.Errorf("an annotated tag needs a message; use -m <msg>"))
+		}
+		_, err = base.CreateAnnotatedTag(args[0], oid, msg, force)
+	} else {
+		err = base.CreateTag(args[0], oid, force)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+		os.Exit(128)
+	}
 }
 
 func kHandler(cmd *cobra.Command, args []string) {
@@ -130,7 +287,9 @@ func kHandler(cmd *cobra.Command, args []string) {
 		}
 		dot += fmt.Sprintf("\"%s\" [shape=note]\n", names[i])
 		dot += fmt.Sprintf("\"%s\" -> \"%x\"", names[i], ref.Value)
-		oidset = append(oidset, ref.Value)
+		if oid, err := base.Peel(ref.Value, data.Commit); err == nil {
+			oidset = append(oidset, oid)
+		}
 	}
 
 	if oidset, err = base.GetCommitsAndParents(oidset); err != nil {
@@ -138,12 +297,12 @@ func kHandler(cmd *cobra.Command, args []string) {
 	}
 
 	for _, oid := range oidset {
-		_, p, _, err := base.GetCommit(oid)
+		c, err := base.GetCommit(oid)
 		if err != nil {
 			panic(err)
 		}
 		dot += fmt.Sprintf("\"%x\" [shape=box style=filled label=\"%x\"]\n", oid, oid[:10])
-		if len(p) > 0 {
+		for _, p := range c.Parents {
 			dot += fmt.Sprintf("\"%x\" -> \"%x\"\n", oid, p)
 		}
 	}
@@ -169,18 +328,45 @@ func kHandler(cmd *cobra.Command, args []string) {
 }
 
 func branchHandler(cmd *cobra.Command, args []string) {
-	if len(args) == 0 {
-		c, err := base.GetBranchName()
-		if err != nil {
-			panic(err)
+	del, _ := cmd.Flags().GetBool("delete")
+	move, _ := cmd.Flags().GetBool("move")
+	force, _ := cmd.Flags().GetBool("force")
+	if D, _ := cmd.Flags().GetBool("force-delete"); D {
+		del, force = true, true
+	}
+	switch {
+	case del:
+		if len(args) == 0 {
+			panic(fmt.Errorf("usage: ugit branch -d <branchname>..."))
 		}
-		bs, err := base.GetBranchNames()
-		if err != nil {
-			panic(err)
+		for _, name := range args {
+			oid, err := base.DeleteBranch(name, force)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Deleted branch %s (was %s).\n", name, base.ShortOid(oid))
+		}
+		return
+	case move:
+		if len(args) == 0 {
+			panic(fmt.Errorf("usage: ugit branch -m [<oldbranch>] <newbranch>"))
 		}
-		for _, b := range bs {
-			fmt.Printf("%t %s\n", b == c, b)
+		if len(args) == 1 {
+			b, err := base.GetBranchName()
+			if err != nil || len(b) == 0 {
+				fmt.Fprintf(os.Stderr, "fatal: not on any branch\n")
+				os.Exit(128)
+			}
+			args = []string{strings.TrimPrefix(b, "refs/heads/"), args[0]}
 		}
+		if err := base.RenameBranch(args[0], args[1], force); err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+			os.Exit(128)
+		}
+		return
+	case len(args) == 0:
+		listBranches(cmd)
 		return
 	}
 	if len(args) == 1 {
@@ -190,49 +376,259 @@ func branchHandler(cmd *cobra.Command, args []string) {
 	if err != nil {
 		panic(err)
 	}
+	if oid, err = base.Peel(oid, data.Commit); err != nil {
+		panic(err)
+	}
 	if err := base.CreateBranch(args[0], oid); err != nil {
 		panic(err)
 	}
 }
 
-func statusHandler(cmd *cobra.Command, args []string) {
-	head, err := base.GetOid("@")
+// listBranches print branches marking the current one with `*`,
+// keeping those matching --contains and --merged
+func listBranches(cmd *cobra.Command) {
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	filter := func(flag string) []byte {
+		if !cmd.Flags().Changed(flag) {
+			return nil
+		}
+		rev, _ := cmd.Flags().GetString(flag)
+		oid, err := base.GetOid(rev)
+		if err != nil {
+			panic(err)
+		}
+		if oid, err = base.Peel(oid, data.Commit); err != nil {
+			panic(err)
+		}
+		return oid
+	}
+	contains, merged := filter("contains"), filter("merged")
+	// a repository without HEAD yet has no current branch
+	cur, _ := base.GetBranchName()
+	bs, err := base.GetBranchNames()
 	if err != nil {
 		panic(err)
 	}
-	b, err := base.GetBranchName()
+	type branch struct {
+		name    string
+		oid     []byte
+		current bool
+	}
+	list := []branch{}
+	if len(cur) == 0 {
+		if head, err := base.GetOid("@"); err == nil {
+			list = append(list, branch{fmt.Sprintf("(HEAD detached at %s)", base.ShortOid(head)), head, true})
+		}
+	}
+	for _, b := range bs {
+		oid, err := base.GetOid(b)
+		if err != nil {
+			panic(err)
+		}
+		list = append(list, branch{strings.TrimPrefix(b, "refs/heads/"), oid, b == cur})
+	}
+	width := 0
+	for _, b := range list {
+		if len(b.name) > width {
+			width = len(b.name)
+		}
+	}
+	for _, b := range list {
+		if contains != nil {
+			if ok, err := base.IsAncestor(contains, b.oid); err != nil {
+				panic(err)
+			} else if !ok {
+				continue
+			}
+		}
+		if merged != nil {
+			if ok, err := base.IsAncestor(b.oid, merged); err != nil {
+				panic(err)
+			} else if !ok {
+				continue
+			}
+		}
+		mark := " "
+		if b.current {
+			mark = "*"
+		}
+		if !verbose {
+			fmt.Printf("%s %s\n", mark, b.name)
+			continue
+		}
+		c, err := base.GetCommit(b.oid)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%s %-*s %s %s\n", mark, width, b.name, base.ShortOid(b.oid), c.Subject())
+	}
+}
+
+func statusHandler(cmd *cobra.Command, args []string) {
+	sts, err := base.Status()
 	if err != nil {
 		panic(err)
 	}
+	if porcelain, _ := cmd.Flags().GetBool("porcelain"); porcelain {
+		for _, st := range sts {
+			fmt.Printf("%c%c %s\n", st.Staged, st.Unstaged, st.Path)
+		}
+		return
+	}
+	b, _ := base.GetBranchName()
 	if len(b) > 0 {
-		fmt.Printf("On branch %s\n", b)
-	} else {
+		fmt.Printf("On branch %s\n", strings.TrimPrefix(b, "refs/heads/"))
+	} else if head, err := base.GetOid("@"); err == nil {
 		fmt.Printf("HEAD detached at %x\n", head[:10])
 	}
-	fmt.Printf("Changes to be committed:\n\n")
-	t, _, _, err := base.GetCommit(head)
-	if err != nil {
-		panic(err)
+	if _, err := base.GetOid("@"); err != nil {
+		fmt.Printf("No commits yet\n")
+	}
+	if base.RebaseInProgress() {
+		fmt.Printf("You are currently rebasing.\n  (fix conflicts and run \"ugit rebase --continue\")\n")
+	}
+	names := map[byte]string{
+		'A': "new file",
+		'M': "modified",
+		'D': "deleted",
+		'U': "both modified",
+	}
+	sections := []struct {
+		title string
+		match func(st base.FileStatus) (byte, bool)
+	}{
+		{"Changes to be committed", func(st base.FileStatus) (byte, bool) {
+			return st.Staged, st.Staged != ' ' && st.Staged != '?' && st.Staged != 'U'
+		}},
+		{"Unmerged paths", func(st base.FileStatus) (byte, bool) {
+			return st.Staged, st.Staged == 'U'
+		}},
+		{"Changes not staged for commit", func(st base.FileStatus) (byte, bool) {
+			return st.Unstaged, st.Unstaged != ' ' && st.Unstaged != '?' && st.Unstaged != 'U'
+		}},
+		{"Untracked files", func(st base.FileStatus) (byte, bool) {
+			return st.Unstaged, st.Unstaged == '?'
+		}},
+	}
+	clean := true
+	for _, sec := range sections {
+		lines := ""
+		for _, st := range sts {
+			c, ok := sec.match(st)
+			if !ok {
+				continue
+			}
+			if c == '?' {
+				lines += fmt.Sprintf("\t%s\n", st.Path)
+				continue
+			}
+			lines += fmt.Sprintf("\t%-13s %s\n", names[c]+":", st.Path)
+		}
+		if len(lines) > 0 {
+			clean = false
+			fmt.Printf("\n%s:\n%s", sec.title, lines)
+		}
 	}
-	nt, err := base.WriteTree(".")
-	if err != nil {
+	if clean {
+		fmt.Printf("nothing to commit, working tree clean\n")
+	}
+}
+
+func addHandler(cmd *cobra.Command, args []string) {
+	if err := base.Add(repoPaths(args)); err != nil {
 		panic(err)
 	}
-	out, err := diff.GetTreesDiff(t, nt)
-	if err != nil {
+}
+
+func rmHandler(cmd *cobra.Command, args []string) {
+	cached, _ := cmd.Flags().GetBool("cached")
+	if err := base.Remove(repoPaths(args), cached); err != nil {
 		panic(err)
 	}
-	fmt.Printf("%s", out)
 }
 
 func resetHandler(cmd *cobra.Command, args []string) {
-	oid, err := base.GetOid(args[0])
+	mode, modes := base.ResetMixed, 0
+	for _, m := range []base.ResetMode{base.ResetSoft, base.ResetMixed, base.ResetHard} {
+		if set, _ := cmd.Flags().GetBool(m.String()); set {
+			mode = m
+			modes++
+		}
+	}
+	if modes > 1 {
+		panic(fmt.Errorf("only one of --soft, --mixed and --hard may be given"))
+	}
+	rev, paths := "", args
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		if dash > 1 {
+			panic(fmt.Errorf("only one revision may be given before --"))
+		}
+		if dash == 1 {
+			rev = args[0]
+		}
+		paths = args[dash:]
+	} else if len(args) > 0 {
+		if _, err := base.GetOid(args[0]); err == nil {
+			rev, paths = args[0], args[1:]
+		}
+	}
+	if len(rev) == 0 {
+		rev = "@"
+	}
+	if len(paths) > 0 {
+		if mode != base.ResetMixed {
+			fmt.Fprintf(os.Stderr, "fatal: Cannot do %s reset with paths.\n", mode)
+			os.Exit(128)
+		}
+		oid, err := base.GetOid(rev)
+		if err != nil && rev != "@" {
+			panic(err)
+		}
+		if err == nil {
+			if oid, err = base.Peel(oid, data.Commit); err != nil {
+				panic(err)
+			}
+		}
+		if err := base.ResetPaths(oid, repoPaths(paths)); err != nil {
+			panic(err)
+		}
+		return
+	}
+	oid, err := base.GetOid(rev)
 	if err != nil {
 		panic(err)
 	}
-	if err := data.UpdateRef("HEAD", data.RefValue{Symblic: false, Value: oid}, true); err != nil {
+	if oid, err = base.Peel(oid, data.Commit); err != nil {
 		panic(err)
 	}
+	if err := base.Reset(oid, mode, "reset: moving to "+rev); err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+		os.Exit(128)
+	}
+	switch mode {
+	case base.ResetMixed:
+		sts, err := base.Status()
+		if err != nil {
+			panic(err)
+		}
+		header := false
+		for _, st := range sts {
+			if st.Unstaged == ' ' || st.Unstaged == '?' {
+				continue
+			}
+			if !header {
+				fmt.Printf("Unstaged changes after reset:\n")
+				header = true
+			}
+			fmt.Printf("%c\t%s\n", st.Unstaged, st.Path)
+		}
+	case base.ResetHard:
+		c, err := base.GetCommit(oid)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("HEAD is now at %s %s\n", base.ShortOid(oid), c.Subject())
+	}
 }
 
 func showHandler(cmd *cobra.Command, args []string) {
@@ -240,21 +636,42 @@ func showHandler(cmd *cobra.Command, args []string) {
 	if err != nil {
 		panic(err)
 	}
-	if err := base.PrintCommit(oid, nil); err != nil {
+	for {
+		t, err := data.GetType(oid)
+		if err != nil {
+			panic(err)
+		}
+		if t != data.Tag {
+			break
+		}
+		if err := base.PrintTag(oid); err != nil {
+			panic(err)
+		}
+		tag, err := base.GetTag(oid)
+		if err != nil {
+			panic(err)
+		}
+		oid = tag.Object
+	}
+	decos, err := base.GetDecorations()
+	if err != nil {
 		panic(err)
 	}
-	ntoid, p, _, err := base.GetCommit(oid)
+	if err := base.PrintCommit(oid, decos[fmt.Sprintf("%x", oid)]); err != nil {
+		panic(err)
+	}
+	c, err := base.GetCommit(oid)
 	if err != nil {
 		panic(err)
 	}
-	if len(p) == 0 {
+	if len(c.Parents) == 0 {
 		return
 	}
-	ptoid, _, _, err := base.GetCommit(p)
+	pc, err := base.GetCommit(c.Parent())
 	if err != nil {
 		panic(err)
 	}
-	out, err := diff.GetTreesDiff(ptoid, ntoid)
+	out, err := diff.GetTreesDiff(data.Default, pc.Tree, c.Tree, diffOptions(cmd))
 	if err != nil {
 		panic(err)
 	}
@@ -265,23 +682,316 @@ func diffHandler(cmd *cobra.Command, args []string) {
 	if len(args) == 0 {
 		args = append(args, "@")
 	}
-	oid, err := base.GetOid(args[0])
+	r, isRange, err := base.ParseRange(args[0])
+	if err != nil {
+		panic(err)
+	}
+	var from, to []byte
+	if isRange {
+		if r.Symmetric {
+			if r.From, err = base.GetMergeBase(r.From, r.To); err != nil {
+				panic(err)
+			}
+			if r.From == nil {
+				panic(fmt.Errorf("%s: no merge base", args[0]))
+			}
+		}
+		fc, err := base.GetCommit(r.From)
+		if err != nil {
+			panic(err)
+		}
+		tc, err := base.GetCommit(r.To)
+		if err != nil {
+			panic(err)
+		}
+		from, to = fc.Tree, tc.Tree
+	} else {
+		oid, err := base.GetOid(args[0])
+		if err != nil {
+			panic(err)
+		}
+		if oid, err = base.Peel(oid, data.Commit); err != nil {
+			panic(err)
+		}
+		c, err := base.GetCommit(oid)
+		if err != nil {
+			panic(err)
+		}
+		from = c.Tree
+		if to, err = base.WriteTree("."); err != nil {
+			panic(err)
+		}
+	}
+	out, err := diff.GetTreesDiff(data.Default, from, to, diffOptions(cmd))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("%s", out)
+}
+
+func diffOptions(cmd *cobra.Command) diff.Options {
+	opt := diff.DefaultOptions
+	opt.Context, _ = cmd.Flags().GetInt("unified")
+	if name, _ := cmd.Flags().GetString("diff-algorithm"); len(name) > 0 {
+		alg, err := diff.ParseAlgorithm(name)
+		if err != nil {
+			panic(err)
+		}
+		opt.Algorithm = alg
+	}
+	return opt
+}
+
+func migrateHandler(cmd *cobra.Command, args []string) {
+	updated, err := base.Migrate()
 	if err != nil {
 		panic(err)
 	}
-	t, _, _, err := base.GetCommit(oid)
+	for _, u := range updated {
+		fmt.Println(u)
+	}
+}
+
+func configHandler(cmd *cobra.Command, args []string) {
+	if len(args) == 2 {
+		if err := data.SetConfig(args[0], args[1]); err != nil {
+			panic(err)
+		}
+		return
+	}
+	v, err := data.GetConfig(args[0])
 	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(v)
+}
+
+func gcHandler(cmd *cobra.Command, args []string) {
+	if err := base.GC(); err != nil {
 		panic(err)
 	}
-	nt, err := base.WriteTree(".")
+}
+
+func pruneHandler(cmd *cobra.Command, args []string) {
+	expire, err := base.GetPruneExpire()
 	if err != nil {
 		panic(err)
 	}
-	out, err := diff.GetTreesDiff(t, nt)
+	if e, _ := cmd.Flags().GetString("expire"); len(e) > 0 {
+		if expire, err = base.ParseExpire(e); err != nil {
+			panic(err)
+		}
+	}
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	pruned, err := base.Prune(expire, dryRun)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("%s", out)
+	for _, o := range pruned {
+		if !dryRun {
+			fmt.Printf("%x\n", o)
+			continue
+		}
+		t, _ := data.GetType(o)
+		fmt.Printf("%x %s\n", o, t)
+	}
+}
+
+func fsckHandler(cmd *cobra.Command, args []string) {
+	report, err := base.Fsck()
+	if err != nil {
+		panic(err)
+	}
+	if j, _ := cmd.Flags().GetBool("json"); j {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(b))
+	} else {
+		for _, p := range report.Problems {
+			fmt.Println(p)
+		}
+		fmt.Printf("checked %d objects, %d refs\n", report.Objects, report.Refs)
+	}
+	if report.Corrupt() {
+		os.Exit(1)
+	}
+}
+
+func revParseHandler(cmd *cobra.Command, args []string) {
+	for _, arg := range args {
+		r, isRange, err := base.ParseRange(arg)
+		if err != nil {
+			panic(err)
+		}
+		if !isRange {
+			oid, err := base.GetOid(arg)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("%x\n", oid)
+			continue
+		}
+		fmt.Printf("%x\n", r.To)
+		if !r.Symmetric {
+			fmt.Printf("^%x\n", r.From)
+			continue
+		}
+		fmt.Printf("%x\n", r.From)
+		mb, err := base.GetMergeBase(r.From, r.To)
+		if err != nil {
+			panic(err)
+		}
+		if mb != nil {
+			fmt.Printf("^%x\n", mb)
+		}
+	}
+}
+
+func reflogHandler(cmd *cobra.Command, args []string) {
+	ref := "HEAD"
+	if len(args) > 0 {
+		ref = args[0]
+	}
+	_, ents, err := base.GetReflog(ref)
+	if err != nil {
+		panic(err)
+	}
+	for i := len(ents) - 1; i >= 0; i-- {
+		e := ents[i]
+		fmt.Printf("%s %s@{%d}: %s\n", base.ShortOid(e.New), ref, len(ents)-1-i, e.Message)
+	}
+}
+
+func updateRefHandler(cmd *cobra.Command, args []string) {
+	msg, _ := cmd.Flags().GetString("message")
+	del, _ := cmd.Flags().GetBool("delete")
+	noDeref, _ := cmd.Flags().GetBool("no-deref")
+	oldArg := 2
+	if del {
+		oldArg = 1
+	} else if len(args) < 2 {
+		panic(fmt.Errorf("usage: ugit update-ref <ref> <new> [<old>]"))
+	}
+	if len(args) > oldArg+1 {
+		panic(fmt.Errorf("too many arguments"))
+	}
+	var old []byte
+	if len(args) > oldArg {
+		// an empty old value means the ref must not exist yet
+		old = make([]byte, sha1.Size)
+		if len(args[oldArg]) > 0 {
+			oid, err := base.GetOid(args[oldArg])
+			if err != nil {
+				panic(err)
+			}
+			old = oid
+		}
+	}
+	var err error
+	if del {
+		err = data.CompareAndDeleteRef(args[0], old, !noDeref)
+	} else {
+		oid, gerr := base.GetOid(args[1])
+		if gerr != nil {
+			panic(gerr)
+		}
+		err = data.CompareAndSwapRef(args[0], old, data.RefValue{Symblic: false, Value: oid}, !noDeref, msg)
+	}
+	switch err.(type) {
+	case nil:
+	case *data.RefMismatchError, *data.LockError:
+		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+		os.Exit(128)
+	default:
+		panic(err)
+	}
+}
+
+// editFile open path in user's editor: $UGIT_EDITOR, core.editor, $VISUAL, $EDITOR or vi
+func editFile(path string) error {
+	editor := os.Getenv("UGIT_EDITOR")
+	if len(editor) == 0 {
+		editor, _ = data.GetConfig("core.editor")
+	}
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if len(editor) == 0 {
+			editor = os.Getenv(env)
+		}
+	}
+	if len(editor) == 0 {
+		editor = "vi"
+	}
+	c := exec.Command("sh", "-c", editor+` "$@"`, editor, path)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("there was a problem with the editor '%s': %v", editor, err)
+	}
+	return nil
+}
+
+func rebaseHandler(cmd *cobra.Command, args []string) {
+	cont, _ := cmd.Flags().GetBool("continue")
+	skip, _ := cmd.Flags().GetBool("skip")
+	abort, _ := cmd.Flags().GetBool("abort")
+	interactive, _ := cmd.Flags().GetBool("interactive")
+	opt := base.RebaseOptions{Interactive: interactive, Edit: editFile}
+	var err error
+	switch {
+	case cont || skip || abort:
+		if len(args) > 0 || interactive {
+			panic(fmt.Errorf("--continue, --skip and --abort take no other arguments"))
+		}
+		switch {
+		case cont:
+			err = base.RebaseContinue(opt)
+		case skip:
+			err = base.RebaseSkip(opt)
+		default:
+			err = base.RebaseAbort()
+		}
+	case len(args) == 1:
+		err = base.Rebase(args[0], opt)
+	default:
+		panic(fmt.Errorf("usage: ugit rebase [-i] <upstream>"))
+	}
+	if _, ok := err.(*base.RebaseConflictError); ok {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+		os.Exit(128)
+	}
+}
+
+func checkIgnoreHandler(cmd *cobra.Command, args []string) {
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	ig, err := base.LoadIgnore()
+	if err != nil {
+		panic(err)
+	}
+	ignored := false
+	for i, p := range repoPaths(args) {
+		fi, err := os.Stat(args[i])
+		r := ig.Match(p, err == nil && fi.IsDir())
+		if r == nil || (r.Negate() && !verbose) {
+			continue
+		}
+		if !r.Negate() {
+			ignored = true
+		}
+		if verbose {
+			fmt.Printf("%s:%d:%s\t%s\n", r.Source, r.Line, r.Pattern, args[i])
+		} else {
+			fmt.Println(args[i])
+		}
+	}
+	if !ignored {
+		os.Exit(1)
+	}
 }
 
 func main() {
@@ -292,7 +1002,10 @@ func main() {
 		Run: func(cmd *cobra.Command, args []string) {
 			// Do Stuff Here
 		},
+		PersistentPreRun: setupRepository,
 	}
+	rootCmd.PersistentFlags().StringP("chdir", "C", "", "Run as if ugit was started in this directory")
+	rootCmd.PersistentFlags().String("git-dir", "", "Path to the repository's git directory")
 	initCmd := &cobra.Command{
 		Use:   "init",
 		Short: "Create an empty ugit repository or reinitialize an existing one",
@@ -327,8 +1040,10 @@ func main() {
 		Use:   "commit",
 		Short: "commit [commit message]",
 		Run:   commitHandler,
-		Args:  cobra.ExactArgs(1),
+		Args:  cobra.MaximumNArgs(1),
 	}
+	commitCmd.Flags().String("author", "", "Override the commit author, in the form \"Name <email>\"")
+	commitCmd.Flags().String("date", "", "Override the author date")
 	logCmd := &cobra.Command{
 		Use:   "log",
 		Short: "Show commit logs",
@@ -341,12 +1056,19 @@ func main() {
 		Run:   checkoutHandler,
 		Args:  cobra.ExactArgs(1),
 	}
+	checkoutCmd.Flags().BoolP("force", "f", false, "Throw away local modifications")
+	checkoutCmd.Flags().BoolP("merge", "m", false, "Merge local modifications into the target version")
 	tagCmd := &cobra.Command{
-		Use:   "tag",
-		Short: "Create a tag object",
+		Use:   "tag [-a -m <msg>] <tagname> [<rev>]",
+		Short: "Create, list or delete tags",
 		Run:   tagHandler,
-		Args:  cobra.RangeArgs(1, 2),
+		Args:  cobra.ArbitraryArgs,
 	}
+	tagCmd.Flags().BoolP("annotate", "a", false, "Make an annotated tag object")
+	tagCmd.Flags().StringP("message", "m", "", "Tag message, implies -a")
+	tagCmd.Flags().BoolP("list", "l", false, "List tags matching an optional pattern")
+	tagCmd.Flags().BoolP("delete", "d", false, "Delete tags")
+	tagCmd.Flags().BoolP("force", "f", false, "Replace an existing tag")
 	kCmd := &cobra.Command{
 		Use:   "k",
 		Short: "Visualize tool like gitk",
@@ -357,20 +1079,45 @@ func main() {
 		Use:   "branch",
 		Short: "List, create, or delete branches",
 		Run:   branchHandler,
-		Args:  cobra.MaximumNArgs(2),
-	}
+		Args:  cobra.ArbitraryArgs,
+	}
+	branchCmd.Flags().BoolP("delete", "d", false, "Delete fully merged branches")
+	branchCmd.Flags().BoolP("force-delete", "D", false, "Shortcut for --delete --force")
+	branchCmd.Flags().BoolP("move", "m", false, "Rename a branch, with its reflog")
+	branchCmd.Flags().BoolP("force", "f", false, "Delete unmerged branches, or rename over an existing one")
+	branchCmd.Flags().BoolP("verbose", "v", false, "Show the tip commit of each branch")
+	branchCmd.Flags().String("contains", "", "List only branches containing the commit")
+	branchCmd.Flags().String("merged", "", "List only branches merged into the commit, HEAD unless given as --merged=<rev>")
+	branchCmd.Flags().Lookup("merged").NoOptDefVal = "@"
 	statusCmd := &cobra.Command{
 		Use:   "status",
 		Short: "Show the working tree status",
 		Run:   statusHandler,
 		Args:  cobra.NoArgs,
 	}
+	statusCmd.Flags().Bool("porcelain", false, "Give the output in an easy-to-parse format for scripts")
 	resetCmd := &cobra.Command{
-		Use:   "reset",
-		Short: "Reset current HEAD to the specified state",
+		Use:   "reset [--soft | --mixed | --hard] [<rev>] [--] [<paths>...]",
+		Short: "Reset current HEAD to the specified state, or unstage paths",
 		Run:   resetHandler,
-		Args:  cobra.ExactArgs(1),
-	}
+		Args:  cobra.ArbitraryArgs,
+	}
+	resetCmd.Flags().Bool("soft", false, "Move HEAD only, keeping index and working tree")
+	resetCmd.Flags().Bool("mixed", false, "Move HEAD and reset index, keeping working tree (default)")
+	resetCmd.Flags().Bool("hard", false, "Move HEAD and reset index and working tree, discarding local changes")
+	addCmd := &cobra.Command{
+		Use:   "add <paths>...",
+		Short: "Add file contents to the index",
+		Run:   addHandler,
+		Args:  cobra.MinimumNArgs(1),
+	}
+	rmCmd := &cobra.Command{
+		Use:   "rm <paths>...",
+		Short: "Remove files from the working tree and from the index",
+		Run:   rmHandler,
+		Args:  cobra.MinimumNArgs(1),
+	}
+	rmCmd.Flags().Bool("cached", false, "Only remove from the index")
 	showCmd := &cobra.Command{
 		Use:   "show",
 		Short: "Show various types of objects",
@@ -383,6 +1130,88 @@ func main() {
 		Run:   diffHandler,
 		Args:  cobra.MaximumNArgs(1),
 	}
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Rewrite legacy trees and commits into the current object format",
+		Run:   migrateHandler,
+		Args:  cobra.NoArgs,
+	}
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Get and set repository options",
+		Run:   configHandler,
+		Args:  cobra.RangeArgs(1, 2),
+	}
+	mergeCmd := &cobra.Command{
+		Use:   "merge",
+		Short: "Join two development histories together",
+		Run:   mergeHandler,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	for _, c := range []*cobra.Command{showCmd, diffCmd} {
+		c.Flags().IntP("unified", "U", diff.DefaultOptions.Context, "Generate diffs with <n> lines of context")
+		c.Flags().String("diff-algorithm", string(diff.DefaultOptions.Algorithm), "Choose a diff algorithm: myers, patience or histogram")
+	}
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Pack reachable objects and remove their loose copies",
+		Run:   gcHandler,
+		Args:  cobra.NoArgs,
+	}
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove unreachable loose objects older than the grace period",
+		Run:   pruneHandler,
+		Args:  cobra.NoArgs,
+	}
+	pruneCmd.Flags().BoolP("dry-run", "n", false, "Only list the objects that would be removed")
+	pruneCmd.Flags().String("expire", "", "Only prune objects older than this, e.g. now or 2.weeks.ago")
+	fsckCmd := &cobra.Command{
+		Use:   "fsck",
+		Short: "Verify the connectivity and validity of the objects and refs",
+		Run:   fsckHandler,
+		Args:  cobra.NoArgs,
+	}
+	fsckCmd.Flags().Bool("json", false, "Print the report as JSON")
+	checkIgnoreCmd := &cobra.Command{
+		Use:   "check-ignore",
+		Short: "Debug ugitignore / exclude files",
+		Run:   checkIgnoreHandler,
+		Args:  cobra.MinimumNArgs(1),
+	}
+	checkIgnoreCmd.Flags().BoolP("verbose", "v", false, "Output details about the matching pattern")
+	reflogCmd := &cobra.Command{
+		Use:   "reflog [<ref>]",
+		Short: "Show the log of updates to a ref, HEAD by default",
+		Run:   reflogHandler,
+		Args:  cobra.MaximumNArgs(1),
+	}
+	updateRefCmd := &cobra.Command{
+		Use:   "update-ref <ref> <new> [<old>]",
+		Short: "Update the object name stored in a ref safely",
+		Run:   updateRefHandler,
+		Args:  cobra.RangeArgs(1, 3),
+	}
+	updateRefCmd.Flags().StringP("message", "m", "", "Reason recorded in the reflog")
+	updateRefCmd.Flags().BoolP("delete", "d", false, "Delete the ref, after verifying it still holds <old> if given")
+	updateRefCmd.Flags().Bool("no-deref", false, "Update the ref itself rather than the ref it points to")
+	rebaseCmd := &cobra.Command{
+		Use:   "rebase [-i] <upstream> | --continue | --skip | --abort",
+		Short: "Reapply commits on top of another base tip",
+		Run:   rebaseHandler,
+		Args:  cobra.MaximumNArgs(1),
+	}
+	rebaseCmd.Flags().BoolP("interactive", "i", false, "Edit the list of commits to rebase before replaying them")
+	rebaseCmd.Flags().Bool("continue", false, "Continue after resolving conflicts or editing a commit")
+	rebaseCmd.Flags().Bool("skip", false, "Skip the commit that stopped the rebase")
+	rebaseCmd.Flags().Bool("abort", false, "Abort and restore the branch as it was before the rebase")
+	revParseCmd := &cobra.Command{
+		Use:   "rev-parse <revs>...",
+		Short: "Resolve revision expressions and ranges into object IDs",
+		Run:   revParseHandler,
+		Args:  cobra.MinimumNArgs(1),
+	}
 
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(hashCmd)
@@ -399,6 +1228,19 @@ func main() {
 	rootCmd.AddCommand(resetCmd)
 	rootCmd.AddCommand(showCmd)
 	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(addCmd)
+	rootCmd.AddCommand(rmCmd)
+	rootCmd.AddCommand(mergeCmd)
+	rootCmd.AddCommand(gcCmd)
+	rootCmd.AddCommand(pruneCmd)
+	rootCmd.AddCommand(fsckCmd)
+	rootCmd.AddCommand(checkIgnoreCmd)
+	rootCmd.AddCommand(revParseCmd)
+	rootCmd.AddCommand(reflogCmd)
+	rootCmd.AddCommand(updateRefCmd)
+	rootCmd.AddCommand(rebaseCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
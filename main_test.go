@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	base "github.com/KoyamaSohei/ugit/base"
+	data "github.com/KoyamaSohei/ugit/data"
 	"gotest.tools/v3/assert"
 )
 
@@ -28,6 +35,16 @@ func TestMain(m *testing.M) {
 	os.Exit(ret)
 }
 
+func TestAdd(t *testing.T) {
+	add := exec.Command("./ugit", "add", ".")
+	write := exec.Command("./ugit", "write-tree")
+	err := add.Run()
+	assert.NilError(t, err)
+	out, err := write.Output()
+	assert.NilError(t, err)
+	assert.Assert(t, len(strings.TrimSpace(string(out))) == 40)
+}
+
 func TestCommit(t *testing.T) {
 	commit := exec.Command("./ugit", "commit", "hello-ugit")
 	err := commit.Run()
@@ -63,3 +80,855 @@ func TestCheckout(t *testing.T) {
 	err = checkout.Run()
 	assert.NilError(t, err)
 }
+
+func TestMigrate(t *testing.T) {
+	commit := exec.Command("./ugit", "commit", "hello-ugit")
+	migrate := exec.Command("./ugit", "migrate")
+	log := exec.Command("./ugit", "log")
+	err := commit.Run()
+	assert.NilError(t, err)
+	err = migrate.Run()
+	assert.NilError(t, err)
+	err = log.Run()
+	assert.NilError(t, err)
+
+	// a repository written in the legacy tree and commit format
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	assert.NilError(t, ugit("init").Run())
+	repo := data.NewRepository(dir)
+	sep := []byte{0, 0}
+	// legacy objects hold raw oids between 00 00 separators, so oids must not hold 00
+	var a, b, lc []byte
+	for i := 0; lc == nil; i++ {
+		a = []byte(fmt.Sprintf("a %d\n", i))
+		b = []byte(fmt.Sprintf("b %d\n", i))
+		ao, bo := data.Hash(a, data.Blob), data.Hash(b, data.Blob)
+		sub := bytes.Join([][]byte{bo, []byte("sub/b.txt"), nil}, sep)
+		so := data.Hash(sub, data.Tree)
+		root := bytes.Join([][]byte{ao, []byte("a.txt"), so, []byte("sub"), nil}, sep)
+		ro := data.Hash(root, data.Tree)
+		if bytes.Contains(bytes.Join([][]byte{ao, bo, so, ro}, nil), []byte{0}) {
+			continue
+		}
+		for _, o := range []struct {
+			b []byte
+			t data.Type
+		}{{a, data.Blob}, {b, data.Blob}, {sub, data.Tree}, {root, data.Tree}} {
+			_, err := repo.HashObject(o.b, o.t)
+			assert.NilError(t, err)
+		}
+		lc, err = repo.HashObject(bytes.Join([][]byte{ro, nil, []byte("legacy\n")}, sep), data.Commit)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, ugit("update-ref", "refs/heads/main", fmt.Sprintf("%x", lc)).Run())
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, ".ugit", "HEAD"), []byte("ref:refs/heads/main"), 0644))
+	assert.NilError(t, ugit("tag", "-a", "-m", "legacy release", "v0", "main").Run())
+	out, err := ugit("migrate").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "refs/tags/v0"))
+
+	brepo, err := base.Open(dir)
+	assert.NilError(t, err)
+	head, err := brepo.GetOid("main")
+	assert.NilError(t, err)
+	assert.Assert(t, !bytes.Equal(head, lc))
+	c, err := brepo.GetCommit(head)
+	assert.NilError(t, err)
+	legacy, err := brepo.IsLegacyTree(c.Tree)
+	assert.NilError(t, err)
+	assert.Assert(t, !legacy)
+	peeled, err := ugit("rev-parse", "v0^{}").Output()
+	assert.NilError(t, err)
+	assert.Equal(t, strings.TrimSpace(string(peeled)), fmt.Sprintf("%x", head))
+
+	assert.NilError(t, ugit("checkout", "-f", "main").Run())
+	got, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(got), string(a))
+	got, err = ioutil.ReadFile(filepath.Join(dir, "sub", "b.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(got), string(b))
+}
+
+func TestCommitAuthor(t *testing.T) {
+	config := exec.Command("./ugit", "config", "user.name", "ugit tester")
+	commit := exec.Command("./ugit", "commit", "--author", "Alice <alice@example.com>", "--date", "1600000000 +0900", "hello-ugit")
+	log := exec.Command("./ugit", "log")
+	err := config.Run()
+	assert.NilError(t, err)
+	err = commit.Run()
+	assert.NilError(t, err)
+	out, err := log.Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "author  Alice <alice@example.com>"))
+	assert.Assert(t, strings.Contains(string(out), "committer ugit tester"))
+}
+
+func TestResetPath(t *testing.T) {
+	add := exec.Command("./ugit", "add", "main.go")
+	reset := exec.Command("./ugit", "reset", "--", "main.go")
+	rm := exec.Command("./ugit", "rm", "--cached", "main.go")
+	err := add.Run()
+	assert.NilError(t, err)
+	err = reset.Run()
+	assert.NilError(t, err)
+	err = rm.Run()
+	assert.NilError(t, err)
+	err = exec.Command("./ugit", "add", "main.go").Run()
+	assert.NilError(t, err)
+}
+
+func TestMerge(t *testing.T) {
+	branch := exec.Command("./ugit", "branch", "topic")
+	commit := exec.Command("./ugit", "commit", "hello-ugit")
+	checkout := exec.Command("./ugit", "checkout", "topic")
+	merge := exec.Command("./ugit", "merge", "main")
+	err := branch.Run()
+	assert.NilError(t, err)
+	err = commit.Run()
+	assert.NilError(t, err)
+	err = checkout.Run()
+	assert.NilError(t, err)
+	out, err := merge.Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "Fast-forward"))
+}
+
+func TestDiff(t *testing.T) {
+	for _, alg := range []string{"myers", "patience", "histogram"} {
+		diff := exec.Command("./ugit", "diff", "-U1", "--diff-algorithm", alg)
+		err := diff.Run()
+		assert.NilError(t, err)
+	}
+	diff := exec.Command("./ugit", "diff", "--diff-algorithm", "unknown")
+	err := diff.Run()
+	assert.Assert(t, err != nil)
+}
+
+func TestStatus(t *testing.T) {
+	status := exec.Command("./ugit", "status")
+	err := status.Run()
+	assert.NilError(t, err)
+	f, err := os.Create("untracked.txt")
+	assert.NilError(t, err)
+	f.Close()
+	defer os.Remove("untracked.txt")
+	porcelain := exec.Command("./ugit", "status", "--porcelain")
+	out, err := porcelain.Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "?? untracked.txt\n"))
+}
+
+func TestObjectLayout(t *testing.T) {
+	hash := exec.Command("./ugit", "hash-object", "main.go")
+	out, err := hash.Output()
+	assert.NilError(t, err)
+	oid := string(out)
+	_, err = os.Stat(fmt.Sprintf(".ugit/objects/%s/%s", oid[:2], oid[2:]))
+	assert.NilError(t, err)
+	cat := exec.Command("./ugit", "cat-file", oid)
+	content, err := cat.Output()
+	assert.NilError(t, err)
+	orig, err := ioutil.ReadFile("main.go")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), string(orig))
+}
+
+func TestGC(t *testing.T) {
+	gc := exec.Command("./ugit", "gc")
+	log := exec.Command("./ugit", "log")
+	err := gc.Run()
+	assert.NilError(t, err)
+	packs, err := filepath.Glob(".ugit/objects/pack/pack-*.pack")
+	assert.NilError(t, err)
+	assert.Assert(t, len(packs) > 0)
+	err = log.Run()
+	assert.NilError(t, err)
+}
+
+func TestPrune(t *testing.T) {
+	err := ioutil.WriteFile("unreachable.txt", []byte("unreachable"), 0644)
+	assert.NilError(t, err)
+	defer os.Remove("unreachable.txt")
+	hash := exec.Command("./ugit", "hash-object", "unreachable.txt")
+	out, err := hash.Output()
+	assert.NilError(t, err)
+	dryRun := exec.Command("./ugit", "prune", "--dry-run", "--expire", "now")
+	listed, err := dryRun.Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(listed), string(out)))
+	prune := exec.Command("./ugit", "prune", "--expire", "now")
+	err = prune.Run()
+	assert.NilError(t, err)
+	log := exec.Command("./ugit", "log")
+	err = log.Run()
+	assert.NilError(t, err)
+}
+
+func TestFsck(t *testing.T) {
+	fsck := exec.Command("./ugit", "fsck", "--json")
+	out, err := fsck.Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "\"problems\""))
+}
+
+func TestSubdirectory(t *testing.T) {
+	ugit, err := filepath.Abs("./ugit")
+	assert.NilError(t, err)
+	assert.NilError(t, os.MkdirAll("subdir/nested", 0755))
+	defer os.RemoveAll("subdir")
+	assert.NilError(t, ioutil.WriteFile("subdir/nested/file.txt", []byte("nested\n"), 0644))
+	add := exec.Command(ugit, "add", "nested/file.txt")
+	add.Dir = "subdir"
+	assert.NilError(t, add.Run())
+	status := exec.Command(ugit, "-C", "subdir/nested", "status", "--porcelain")
+	out, err := status.Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "A  subdir/nested/file.txt\n"))
+	rm := exec.Command(ugit, "rm", "--cached", "file.txt")
+	rm.Dir = "subdir/nested"
+	assert.NilError(t, rm.Run())
+}
+
+func TestIgnore(t *testing.T) {
+	assert.NilError(t, os.MkdirAll("ignoretest/build", 0755))
+	defer os.RemoveAll("ignoretest")
+	assert.NilError(t, ioutil.WriteFile("ignoretest/.ugitignore", []byte("*.tmp\n!keep.tmp\nbuild/\n"), 0644))
+	for _, f := range []string{"drop.tmp", "keep.tmp", "ugit-guide.md", "build/out"} {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join("ignoretest", f), []byte(f), 0644))
+	}
+	check := exec.Command("./ugit", "check-ignore", "-v", "ignoretest/drop.tmp", "ignoretest/keep.tmp", "ignoretest/build/out")
+	out, err := check.Output()
+	assert.NilError(t, err)
+	assert.Equal(t, string(out), "ignoretest/.ugitignore:1:*.tmp\tignoretest/drop.tmp\n"+
+		"ignoretest/.ugitignore:2:!keep.tmp\tignoretest/keep.tmp\n"+
+		"ignoretest/.ugitignore:3:build/\tignoretest/build/out\n")
+	notIgnored := exec.Command("./ugit", "check-ignore", "ignoretest/ugit-guide.md")
+	assert.Assert(t, notIgnored.Run() != nil)
+	add := exec.Command("./ugit", "add", "ignoretest")
+	assert.NilError(t, add.Run())
+	defer exec.Command("./ugit", "rm", "--cached", "ignoretest").Run()
+	status := exec.Command("./ugit", "status", "--porcelain")
+	out, err = status.Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "A  ignoretest/ugit-guide.md\n"))
+	assert.Assert(t, strings.Contains(string(out), "A  ignoretest/keep.tmp\n"))
+	assert.Assert(t, !strings.Contains(string(out), "drop.tmp"))
+	assert.Assert(t, !strings.Contains(string(out), "build"))
+}
+
+func TestSafeCheckout(t *testing.T) {
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	assert.NilError(t, ugit("init").Run())
+	for _, v := range []string{"one", "two"} {
+		assert.NilError(t, ioutil.WriteFile(path("safe.txt"), []byte(v+"\n"), 0644))
+		assert.NilError(t, ugit("add", "safe.txt").Run())
+		assert.NilError(t, ugit("commit", "safe "+v).Run())
+		assert.NilError(t, ugit("branch", "safe-"+v).Run())
+	}
+	assert.NilError(t, ugit("checkout", "safe-one").Run())
+	b, err := ioutil.ReadFile(path("safe.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "one\n")
+
+	assert.NilError(t, ioutil.WriteFile(path("safe.txt"), []byte("local\n"), 0644))
+	out, err := ugit("checkout", "safe-two").CombinedOutput()
+	assert.Assert(t, err != nil)
+	assert.Assert(t, strings.Contains(string(out), "\tsafe.txt\n"))
+	b, err = ioutil.ReadFile(path("safe.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "local\n")
+
+	assert.NilError(t, ioutil.WriteFile(path("untracked.txt"), []byte("untracked\n"), 0644))
+	assert.NilError(t, ugit("checkout", "--force", "safe-two").Run())
+	b, err = ioutil.ReadFile(path("safe.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "two\n")
+	_, err = os.Stat(path("untracked.txt"))
+	assert.NilError(t, err)
+}
+
+func TestModes(t *testing.T) {
+	assert.NilError(t, os.MkdirAll("modetest", 0755))
+	defer os.RemoveAll("modetest")
+	assert.NilError(t, ioutil.WriteFile("modetest/run.sh", []byte("echo hi\n"), 0755))
+	assert.NilError(t, os.Symlink("run.sh", "modetest/link"))
+	assert.NilError(t, exec.Command("./ugit", "add", "modetest").Run())
+	assert.NilError(t, exec.Command("./ugit", "commit", "modes").Run())
+	assert.NilError(t, exec.Command("./ugit", "branch", "modes").Run())
+
+	assert.NilError(t, os.Chmod("modetest/run.sh", 0644))
+	out, err := exec.Command("./ugit", "diff").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "mode change 100755 => 100644 modetest/run.sh\n"))
+
+	assert.NilError(t, os.RemoveAll("modetest"))
+	assert.NilError(t, exec.Command("./ugit", "checkout", "--force", "modes").Run())
+	fi, err := os.Lstat("modetest/run.sh")
+	assert.NilError(t, err)
+	assert.Equal(t, fi.Mode().Perm()&0111, os.FileMode(0111))
+	l, err := os.Readlink("modetest/link")
+	assert.NilError(t, err)
+	assert.Equal(t, l, "run.sh")
+	assert.NilError(t, exec.Command("./ugit", "rm", "--cached", "modetest").Run())
+}
+
+func TestRevParse(t *testing.T) {
+	defer os.Remove("rev.txt")
+	for _, v := range []string{"one", "two", "three"} {
+		assert.NilError(t, ioutil.WriteFile("rev.txt", []byte(v+"\n"), 0644))
+		assert.NilError(t, exec.Command("./ugit", "add", "rev.txt").Run())
+		assert.NilError(t, exec.Command("./ugit", "commit", "rev "+v).Run())
+	}
+	rev := func(args ...string) []string {
+		out, err := exec.Command("./ugit", append([]string{"rev-parse"}, args...)...).Output()
+		assert.NilError(t, err)
+		return strings.Fields(string(out))
+	}
+	oids := rev("@", "@~1", "@^^", ":/rev one", "@^{tree}")
+	assert.Equal(t, oids[2], oids[3])
+	assert.Equal(t, rev(oids[0][:8])[0], oids[0])
+	assert.Equal(t, rev("@~1^0")[0], oids[1])
+	assert.Assert(t, oids[4] != oids[0])
+	assert.DeepEqual(t, rev("@~2..@"), []string{oids[0], "^" + oids[2]})
+	assert.Assert(t, exec.Command("./ugit", "rev-parse", "@^2").Run() != nil)
+
+	out, err := exec.Command("./ugit", "log", "@~2..@").Output()
+	assert.NilError(t, err)
+	assert.Equal(t, strings.Count(string(out), "\nmessage "), 2)
+	out, err = exec.Command("./ugit", "diff", "@~1..@").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "-two\n+three\n"))
+
+	assert.NilError(t, exec.Command("./ugit", "branch", "rev-old", "@~2").Run())
+	assert.NilError(t, exec.Command("./ugit", "checkout", "rev-old").Run())
+	assert.Equal(t, rev("@{-1}")[0], oids[0])
+	assert.NilError(t, exec.Command("./ugit", "checkout", "-").Run())
+	assert.Equal(t, rev("@")[0], oids[0])
+}
+
+func TestReflog(t *testing.T) {
+	defer os.Remove("reflog.txt")
+	assert.NilError(t, ioutil.WriteFile("reflog.txt", []byte("reflog\n"), 0644))
+	assert.NilError(t, exec.Command("./ugit", "add", "reflog.txt").Run())
+	assert.NilError(t, exec.Command("./ugit", "commit", "reflog entry").Run())
+	head, err := exec.Command("./ugit", "rev-parse", "@").Output()
+	assert.NilError(t, err)
+	out, err := exec.Command("./ugit", "reflog").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(string(out), string(head[:7])+" HEAD@{0}: commit: reflog entry\n"))
+
+	assert.NilError(t, exec.Command("./ugit", "reset", "@~1").Run())
+	assert.NilError(t, exec.Command("./ugit", "prune", "--expire", "now").Run())
+	prev, err := exec.Command("./ugit", "rev-parse", "HEAD@{1}").Output()
+	assert.NilError(t, err)
+	assert.Equal(t, string(prev), string(head))
+	assert.NilError(t, exec.Command("./ugit", "cat-file", strings.TrimSpace(string(head))).Run())
+	out, err = exec.Command("./ugit", "reflog").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "HEAD@{0}: reset: moving to @~1\n"))
+	assert.NilError(t, exec.Command("./ugit", "reset", "HEAD@{1}").Run())
+}
+
+func TestUpdateRef(t *testing.T) {
+	out, err := exec.Command("./ugit", "rev-parse", "@", "@~1").Output()
+	assert.NilError(t, err)
+	oids := strings.Fields(string(out))
+	assert.NilError(t, exec.Command("./ugit", "update-ref", "refs/heads/cas", oids[1], "").Run())
+	assert.Assert(t, exec.Command("./ugit", "update-ref", "refs/heads/cas", oids[0], "").Run() != nil)
+	out, err = exec.Command("./ugit", "update-ref", "refs/heads/cas", oids[0], oids[0]).CombinedOutput()
+	assert.Assert(t, err != nil)
+	assert.Assert(t, strings.Contains(string(out), "but expected "+oids[0]))
+	assert.NilError(t, exec.Command("./ugit", "update-ref", "refs/heads/cas", oids[0], oids[1]).Run())
+
+	assert.NilError(t, ioutil.WriteFile(".ugit/refs/heads/cas.lock", nil, 0644))
+	out, err = exec.Command("./ugit", "update-ref", "refs/heads/cas", oids[1]).CombinedOutput()
+	assert.Assert(t, err != nil)
+	assert.Assert(t, strings.Contains(string(out), "cas.lock': File exists"))
+	assert.NilError(t, os.Remove(".ugit/refs/heads/cas.lock"))
+	assert.NilError(t, exec.Command("./ugit", "update-ref", "-d", "refs/heads/cas", oids[0]).Run())
+}
+
+func TestPackedRefs(t *testing.T) {
+	assert.NilError(t, exec.Command("./ugit", "branch", "feature/nested").Run())
+	assert.Assert(t, exec.Command("./ugit", "branch", "bad..name").Run() != nil)
+	assert.Assert(t, exec.Command("./ugit", "branch", "feature/nested/deeper").Run() != nil)
+	out, err := exec.Command("./ugit", "branch").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "  feature/nested\n"))
+
+	assert.NilError(t, exec.Command("./ugit", "gc").Run())
+	packed, err := ioutil.ReadFile(".ugit/packed-refs")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(packed), " refs/heads/feature/nested\n"))
+	_, err = os.Stat(".ugit/refs/heads/feature")
+	assert.Assert(t, os.IsNotExist(err))
+	oid, err := exec.Command("./ugit", "rev-parse", "feature/nested").Output()
+	assert.NilError(t, err)
+	head, err := exec.Command("./ugit", "rev-parse", "@").Output()
+	assert.NilError(t, err)
+	assert.Equal(t, string(oid), string(head))
+
+	assert.NilError(t, exec.Command("./ugit", "update-ref", "-d", "refs/heads/feature/nested").Run())
+	packed, err = ioutil.ReadFile(".ugit/packed-refs")
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(packed), "feature/nested"))
+	assert.Assert(t, exec.Command("./ugit", "rev-parse", "feature/nested").Run() != nil)
+}
+
+func TestAnnotatedTag(t *testing.T) {
+	assert.NilError(t, exec.Command("./ugit", "tag", "-a", "-m", "release one", "v1.0").Run())
+	assert.Assert(t, exec.Command("./ugit", "tag", "v1.0").Run() != nil)
+	assert.NilError(t, exec.Command("./ugit", "tag", "light").Run())
+
+	tag, err := exec.Command("./ugit", "rev-parse", "v1.0").Output()
+	assert.NilError(t, err)
+	peeled, err := exec.Command("./ugit", "rev-parse", "v1.0^{}").Output()
+	assert.NilError(t, err)
+	head, err := exec.Command("./ugit", "rev-parse", "@").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, string(tag) != string(head))
+	assert.Equal(t, string(peeled), string(head))
+
+	out, err := exec.Command("./ugit", "show", "v1.0").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "tag     v1.0\n"))
+	assert.Assert(t, strings.Contains(string(out), "release one"))
+	out, err = exec.Command("./ugit", "log").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "refs/tags/v1.0"))
+
+	out, err = exec.Command("./ugit", "tag", "-l", "v*").Output()
+	assert.NilError(t, err)
+	assert.Equal(t, string(out), "v1.0\n")
+	assert.NilError(t, exec.Command("./ugit", "tag", "v1/rc1").Run())
+	out, err = exec.Command("./ugit", "tag", "-l", "v1*").Output()
+	assert.NilError(t, err)
+	assert.Equal(t, string(out), "v1.0\nv1/rc1\n")
+	out, err = exec.Command("./ugit", "tag", "-l", "*rc?").Output()
+	assert.NilError(t, err)
+	assert.Equal(t, string(out), "v1/rc1\n")
+	assert.NilError(t, exec.Command("./ugit", "tag", "-d", "v1/rc1").Run())
+	assert.NilError(t, exec.Command("./ugit", "tag", "-d", "light").Run())
+	assert.Assert(t, exec.Command("./ugit", "tag", "-d", "light").Run() != nil)
+	assert.NilError(t, exec.Command("./ugit", "fsck").Run())
+}
+
+func TestBranch(t *testing.T) {
+	head, err := ioutil.ReadFile(".ugit/HEAD")
+	assert.NilError(t, err)
+	cur := strings.TrimPrefix(string(head), "ref:refs/heads/")
+	assert.NilError(t, exec.Command("./ugit", "branch", "merged").Run())
+	assert.NilError(t, exec.Command("./ugit", "branch", "unmerged").Run())
+	assert.NilError(t, exec.Command("./ugit", "checkout", "unmerged").Run())
+	assert.NilError(t, exec.Command("./ugit", "commit", "unmerged work").Run())
+	assert.NilError(t, exec.Command("./ugit", "checkout", "-").Run())
+
+	out, err := exec.Command("./ugit", "branch").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "* "+cur+"\n"))
+	assert.Assert(t, strings.Contains(string(out), "  unmerged\n"))
+	out, err = exec.Command("./ugit", "branch", "-v").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), " unmerged work\n"))
+	out, err = exec.Command("./ugit", "branch", "--contains", "unmerged").Output()
+	assert.NilError(t, err)
+	assert.Equal(t, string(out), "  unmerged\n")
+	out, err = exec.Command("./ugit", "branch", "--merged").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "  merged\n"))
+	assert.Assert(t, !strings.Contains(string(out), "unmerged"))
+
+	assert.NilError(t, exec.Command("./ugit", "branch", "-d", "merged").Run())
+	assert.Assert(t, exec.Command("./ugit", "branch", "-d", "unmerged").Run() != nil)
+	assert.Assert(t, exec.Command("./ugit", "branch", "-d", cur).Run() != nil)
+
+	assert.NilError(t, exec.Command("./ugit", "branch", "-m", "unmerged", "renamed").Run())
+	out, err = exec.Command("./ugit", "reflog", "renamed").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "renamed@{0}: branch: renamed refs/heads/unmerged to refs/heads/renamed\n"))
+	assert.Assert(t, strings.Contains(string(out), "commit: unmerged work\n"))
+	assert.NilError(t, exec.Command("./ugit", "branch", "-m", "trunk").Run())
+	head, err = ioutil.ReadFile(".ugit/HEAD")
+	assert.NilError(t, err)
+	assert.Equal(t, string(head), "ref:refs/heads/trunk")
+	assert.NilError(t, exec.Command("./ugit", "branch", "-m", "trunk", cur).Run())
+	assert.NilError(t, exec.Command("./ugit", "branch", "-D", "renamed").Run())
+	assert.Assert(t, exec.Command("./ugit", "rev-parse", "renamed").Run() != nil)
+}
+
+func TestResetModes(t *testing.T) {
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	status := func() string {
+		out, err := ugit("status", "--porcelain").Output()
+		assert.NilError(t, err)
+		for _, l := range strings.Split(string(out), "\n") {
+			if strings.HasSuffix(l, " reset.txt") {
+				return l
+			}
+		}
+		return ""
+	}
+	assert.NilError(t, ugit("init").Run())
+	assert.NilError(t, ioutil.WriteFile(path("reset.txt"), []byte("one\n"), 0644))
+	assert.NilError(t, ugit("add", "reset.txt").Run())
+	assert.NilError(t, ugit("commit", "reset one").Run())
+	assert.NilError(t, ioutil.WriteFile(path("reset.txt"), []byte("two\n"), 0644))
+	assert.NilError(t, ugit("add", "reset.txt").Run())
+	assert.NilError(t, ugit("commit", "reset two").Run())
+
+	assert.NilError(t, ugit("reset", "--soft", "@~1").Run())
+	assert.Equal(t, status(), "M  reset.txt")
+	assert.NilError(t, ugit("reset", "--soft", "ORIG_HEAD").Run())
+	assert.Equal(t, status(), "")
+
+	out, err := ugit("reset", "@~1").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "M\treset.txt\n"))
+	assert.Equal(t, status(), " M reset.txt")
+	assert.Assert(t, ugit("reset", "--hard", "@", "--", "reset.txt").Run() != nil)
+
+	assert.NilError(t, ugit("reset", "--hard", "ORIG_HEAD").Run())
+	assert.Equal(t, status(), "")
+	assert.NilError(t, ioutil.WriteFile(path("reset.txt"), []byte("dirty\n"), 0644))
+	assert.NilError(t, ugit("reset", "--hard", "@~1").Run())
+	assert.Equal(t, status(), "")
+	b, err := ioutil.ReadFile(path("reset.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "one\n")
+
+	out, err = ugit("reflog").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(string(out)[8:], "HEAD@{0}: reset: moving to @~1\n"))
+	assert.NilError(t, ugit("reset", "--hard", "ORIG_HEAD").Run())
+
+	// files only staged go away, untracked ones stay
+	assert.NilError(t, os.MkdirAll(path("reset-dir"), 0755))
+	assert.NilError(t, ioutil.WriteFile(path("reset-dir/staged.txt"), []byte("staged\n"), 0644))
+	assert.NilError(t, ugit("add", "reset-dir/staged.txt").Run())
+	assert.NilError(t, ioutil.WriteFile(path("reset-untracked.txt"), []byte("untracked\n"), 0644))
+	assert.NilError(t, ugit("reset", "--hard").Run())
+	_, err = os.Stat(path("reset-dir"))
+	assert.Assert(t, os.IsNotExist(err))
+	_, err = os.Stat(path("reset-untracked.txt"))
+	assert.NilError(t, err)
+}
+
+func TestRebase(t *testing.T) {
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	write := func(name, content string) {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		assert.NilError(t, ugit("add", name).Run())
+	}
+	log := func() string {
+		out, err := ugit("log").Output()
+		assert.NilError(t, err)
+		return string(out)
+	}
+	assert.NilError(t, ugit("init").Run())
+	write("f", "l1\nl2\nl3\n")
+	assert.NilError(t, ugit("commit", "base").Run())
+	assert.NilError(t, ugit("branch", "main").Run())
+	assert.NilError(t, ugit("checkout", "main").Run())
+	assert.NilError(t, ugit("branch", "topic").Run())
+	write("f", "l1\nmain\nl3\n")
+	assert.NilError(t, ugit("commit", "main change").Run())
+	assert.NilError(t, ugit("checkout", "topic").Run())
+	write("f", "l1\ntopic\nl3\n")
+	assert.NilError(t, ugit("commit", "topic change").Run())
+	write("g", "g\n")
+	assert.NilError(t, ugit("commit", "topic g").Run())
+
+	assert.Assert(t, ugit("rebase", "main").Run() != nil)
+	_, err := os.Stat(filepath.Join(dir, ".ugit", "rebase-merge"))
+	assert.NilError(t, err)
+	assert.Assert(t, ugit("rebase", "--continue").Run() != nil)
+	assert.NilError(t, ugit("rebase", "--abort").Run())
+	b, err := ioutil.ReadFile(filepath.Join(dir, "f"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "l1\ntopic\nl3\n")
+	assert.Assert(t, strings.Contains(log(), "(HEAD, refs/heads/topic)\n"))
+
+	assert.Assert(t, ugit("rebase", "main").Run() != nil)
+	write("f", "l1\nboth\nl3\n")
+	assert.NilError(t, ugit("rebase", "--continue").Run())
+	_, err = os.Stat(filepath.Join(dir, ".ugit", "rebase-merge"))
+	assert.Assert(t, os.IsNotExist(err))
+	out := log()
+	assert.Assert(t, strings.Index(out, "message topic g") < strings.Index(out, "message topic change"))
+	assert.Assert(t, strings.Index(out, "message topic change") < strings.Index(out, "message main change"))
+	parent, err := ugit("rev-parse", "topic~2").Output()
+	assert.NilError(t, err)
+	onto, err := ugit("rev-parse", "main").Output()
+	assert.NilError(t, err)
+	assert.Equal(t, string(parent), string(onto))
+
+	write("h", "h\n")
+	assert.NilError(t, ugit("commit", "topic h").Run())
+	edit := ugit("rebase", "-i", "main")
+	edit.Env = append(os.Environ(), `UGIT_EDITOR=sed -i -e "/topic g$/s/^pick/squash/" -e "/topic h$/s/^pick/drop/"`)
+	assert.NilError(t, edit.Run())
+	out = log()
+	assert.Assert(t, strings.Contains(out, "message topic change\n        \n        topic g\n"))
+	assert.Assert(t, !strings.Contains(out, "topic h"))
+	_, err = os.Stat(filepath.Join(dir, "h"))
+	assert.Assert(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "g"))
+	assert.NilError(t, err)
+}
+
+func TestMergeBaseCrossing(t *testing.T) {
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	commit := func(name, content, mes string) {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		assert.NilError(t, ugit("add", name).Run())
+		assert.NilError(t, ugit("commit", mes).Run())
+	}
+	assert.NilError(t, ugit("init").Run())
+	commit("x", "v1\n", "R")
+	assert.NilError(t, ugit("branch", "main").Run())
+	assert.NilError(t, ugit("branch", "side").Run())
+	assert.NilError(t, ugit("checkout", "main").Run())
+	commit("x", "v2\n", "M1")
+	commit("y", "y\n", "M2")
+	assert.NilError(t, ugit("branch", "feat").Run())
+	assert.NilError(t, ugit("checkout", "side").Run())
+	commit("z", "z\n", "S1")
+	assert.NilError(t, ugit("checkout", "feat").Run())
+	commit("x", "v3\n", "F1")
+	commit("w", "w\n", "F2")
+	assert.NilError(t, ugit("merge", "side").Run())
+	assert.NilError(t, ugit("commit", "merge side").Run())
+
+	out, err := ugit("rev-parse", "main...feat").Output()
+	assert.NilError(t, err)
+	main, err := ugit("rev-parse", "main").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasSuffix(string(out), "^"+string(main)))
+
+	assert.NilError(t, ugit("checkout", "main").Run())
+	out, err = ugit("merge", "feat").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "Fast-forward\n"))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "x"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "v3\n")
+}
+
+func TestMergeLocalChanges(t *testing.T) {
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	commit := func(name, content, mes string) {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		assert.NilError(t, ugit("add", name).Run())
+		assert.NilError(t, ugit("commit", mes).Run())
+	}
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.NilError(t, err)
+		return string(b)
+	}
+	assert.NilError(t, ugit("init").Run())
+	commit("a.txt", "a\n", "base")
+	commit("b.txt", "b\n", "base b")
+	assert.NilError(t, ugit("branch", "main").Run())
+	assert.NilError(t, ugit("branch", "feat").Run())
+	assert.NilError(t, ugit("checkout", "feat").Run())
+	commit("b.txt", "feat\n", "feat b")
+	assert.NilError(t, ugit("checkout", "main").Run())
+
+	// fast-forward
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("local\n"), 0644))
+	out, err := ugit("merge", "feat").CombinedOutput()
+	assert.Assert(t, err != nil)
+	assert.Assert(t, strings.Contains(string(out), "overwritten by merge:\n\tb.txt\n"))
+	assert.Equal(t, read("b.txt"), "local\n")
+
+	// three-way
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("b\n"), 0644))
+	commit("a.txt", "main\n", "main a")
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("local\n"), 0644))
+	assert.Assert(t, ugit("merge", "feat").Run() != nil)
+	assert.Equal(t, read("b.txt"), "local\n")
+	assert.Assert(t, ugit("rev-parse", "MERGE_HEAD").Run() != nil)
+
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("b\n"), 0644))
+	assert.NilError(t, ugit("merge", "feat").Run())
+	assert.Equal(t, read("b.txt"), "feat\n")
+}
+
+func TestRebaseEditUpstream(t *testing.T) {
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	commit := func(name, content, mes string) {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		assert.NilError(t, ugit("add", name).Run())
+		assert.NilError(t, ugit("commit", mes).Run())
+	}
+	assert.NilError(t, ugit("init").Run())
+	commit("f", "base\n", "base")
+	assert.NilError(t, ugit("branch", "main").Run())
+	assert.NilError(t, ugit("branch", "topic").Run())
+	assert.NilError(t, ugit("checkout", "main").Run())
+	commit("f", "same\n", "main same")
+	assert.NilError(t, ugit("checkout", "topic").Run())
+	commit("f", "same\n", "topic same")
+	commit("g", "g\n", "topic g")
+
+	edit := ugit("rebase", "-i", "main")
+	edit.Env = append(os.Environ(), `UGIT_EDITOR=sed -i -e "/topic same$/s/^pick/edit/"`)
+	out, err := edit.Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "patch contents already upstream\n"))
+	assert.Assert(t, !strings.Contains(string(out), "Stopped at"))
+	_, err = os.Stat(filepath.Join(dir, ".ugit", "rebase-merge"))
+	assert.Assert(t, os.IsNotExist(err))
+	out, err = ugit("log").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "topic g"))
+	assert.Assert(t, !strings.Contains(string(out), "topic same"))
+	assert.Assert(t, strings.Contains(string(out), "main same"))
+}
+
+func TestRebaseCheckoutFail(t *testing.T) {
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	commit := func(name, content, mes string) {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		assert.NilError(t, ugit("add", name).Run())
+		assert.NilError(t, ugit("commit", mes).Run())
+	}
+	assert.NilError(t, ugit("init").Run())
+	commit("f", "base\n", "base")
+	assert.NilError(t, ugit("branch", "main").Run())
+	assert.NilError(t, ugit("branch", "topic").Run())
+	assert.NilError(t, ugit("checkout", "main").Run())
+	commit("g", "main\n", "main g")
+	assert.NilError(t, ugit("checkout", "topic").Run())
+	commit("f", "topic\n", "topic f")
+
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "g"), []byte("untracked\n"), 0644))
+	out, err := ugit("rebase", "main").CombinedOutput()
+	assert.Assert(t, err != nil)
+	assert.Assert(t, strings.Contains(string(out), "\tg\n"))
+	_, err = os.Stat(filepath.Join(dir, ".ugit", "rebase-merge"))
+	assert.Assert(t, os.IsNotExist(err))
+	assert.Assert(t, ugit("rebase", "--abort").Run() != nil)
+
+	assert.NilError(t, os.Remove(filepath.Join(dir, "g")))
+	assert.NilError(t, ugit("rebase", "main").Run())
+	_, err = os.Stat(filepath.Join(dir, ".ugit", "rebase-merge"))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestRebaseBranchMoved(t *testing.T) {
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	commit := func(name, content, mes string) {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		assert.NilError(t, ugit("add", name).Run())
+		assert.NilError(t, ugit("commit", mes).Run())
+	}
+	revParse := func(rev string) string {
+		out, err := ugit("rev-parse", rev).Output()
+		assert.NilError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+	assert.NilError(t, ugit("init").Run())
+	commit("f", "base\n", "base")
+	assert.NilError(t, ugit("branch", "main").Run())
+	assert.NilError(t, ugit("branch", "topic").Run())
+	assert.NilError(t, ugit("checkout", "main").Run())
+	commit("g", "g\n", "main g")
+	assert.NilError(t, ugit("checkout", "topic").Run())
+	commit("f", "topic\n", "topic f")
+
+	edit := ugit("rebase", "-i", "main")
+	edit.Env = append(os.Environ(), `UGIT_EDITOR=sed -i -e "s/^pick/edit/"`)
+	assert.NilError(t, edit.Run())
+	moved := revParse("main")
+	assert.NilError(t, ugit("update-ref", "refs/heads/topic", moved).Run())
+	out, err := ugit("rebase", "--continue").CombinedOutput()
+	assert.Assert(t, err != nil)
+	assert.Assert(t, strings.Contains(string(out), "refs/heads/topic was updated during rebase"))
+	assert.Equal(t, revParse("topic"), moved)
+	assert.Assert(t, revParse("HEAD") != moved)
+	b, err := ioutil.ReadFile(filepath.Join(dir, ".ugit", "HEAD"))
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.HasPrefix(string(b), "ref:"))
+}
+
+func TestMergeKeepsUnstagedChanges(t *testing.T) {
+	dir := t.TempDir()
+	ugit := func(args ...string) *exec.Cmd {
+		return exec.Command("./ugit", append([]string{"-C", dir}, args...)...)
+	}
+	commit := func(name, content, mes string) {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		assert.NilError(t, ugit("add", name).Run())
+		assert.NilError(t, ugit("commit", mes).Run())
+	}
+	assertDirty := func() {
+		out, err := ugit("status", "--porcelain").Output()
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(string(out), " M a.txt\n"), string(out))
+		out, err = ugit("checkout", "x").CombinedOutput()
+		assert.Assert(t, err != nil)
+		assert.Assert(t, strings.Contains(string(out), "\ta.txt\n"), string(out))
+		b, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+		assert.NilError(t, err)
+		assert.Equal(t, string(b), "local\n")
+	}
+	assert.NilError(t, ugit("init").Run())
+	commit("a.txt", "a\n", "base a")
+	commit("b.txt", "b\n", "base b")
+	for _, b := range []string{"main", "x", "feat", "feat2"} {
+		assert.NilError(t, ugit("branch", b).Run())
+	}
+	assert.NilError(t, ugit("checkout", "x").Run())
+	commit("a.txt", "x\n", "x a")
+	assert.NilError(t, ugit("checkout", "feat").Run())
+	commit("b.txt", "feat\n", "feat b")
+	assert.NilError(t, ugit("checkout", "feat2").Run())
+	commit("c.txt", "c\n", "feat2 c")
+	assert.NilError(t, ugit("checkout", "main").Run())
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("local\n"), 0644))
+
+	out, err := ugit("merge", "feat").Output()
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(out), "Fast-forward\n"))
+	assertDirty()
+
+	assert.NilError(t, ugit("merge", "feat2").Run())
+	assert.NilError(t, ugit("commit", "merge feat2").Run())
+	assertDirty()
+}